@@ -0,0 +1,170 @@
+package writer
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+
+	"tools"
+
+	"datawriter/logger"
+	"datawriter/msg"
+)
+
+// webWriterStartTopic is the pub-sub topic a web-writer announces on
+// when it (re)starts. A restart means every segment it had in flight
+// on this data-writer is orphaned, since the client that owned them is
+// gone and will never send a matching FinishSegment or CancelSegment.
+const webWriterStartTopic = "web-writer-start"
+
+// CancelSegmentsFromNode cancels every in-flight segment in SegmentMap
+// whose source node is sourceNodeName and whose LastActionTime is
+// older than cutoff, both in memory and in the MetadataStore, as a
+// single transaction. It is called in bulk when a web-writer announces
+// that it has restarted, since any segment it previously started but
+// has not touched since cutoff can no longer be completed.
+func (writer *nimbusioWriter) CancelSegmentsFromNode(lgr logger.Logger,
+	sourceNodeName string, cutoff time.Time) error {
+
+	lgr.Debug("CancelSegmentsFromNode %s %s", sourceNodeName, cutoff)
+
+	sourceNodeID, ok := writer.NodeIDMap[sourceNodeName]
+	if !ok {
+		return fmt.Errorf("CancelSegmentsFromNode unknown source node %s", sourceNodeName)
+	}
+
+	writer.mu.RLock()
+	var keys []segmentKey
+	for key, entry := range writer.SegmentMap {
+		if entry.SourceNodeID != sourceNodeID {
+			continue
+		}
+		if entry.LastActionTime.After(cutoff) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	writer.mu.RUnlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Log one CancelSegment WAL record per key, the same as CancelSegment
+	// does for a single segment, before touching the MetadataStore. On
+	// the next restart, WAL replay of each segment's StartSegment record
+	// puts it back into SegmentMap, since SegmentExists still reports its
+	// row; the CancelSegment record after it then either re-applies the
+	// cancel (a crash before Store.CancelSegmentsFromNode committed) or
+	// drops the entry again, so replay does not undo the cascade cancel.
+	for _, key := range keys {
+		cancel := msg.Cancel{UnifiedID: key.UnifiedID, ConjoinedPart: key.ConjoinedPart,
+			SegmentNum: key.SegmentNum}
+		if err := writer.logCancelSegment(cancel); err != nil {
+			return fmt.Errorf("logCancelSegment %s", err)
+		}
+	}
+
+	if err := writer.Store.CancelSegmentsFromNode(sourceNodeID, keys); err != nil {
+		return fmt.Errorf("CancelSegmentsFromNode %s", err)
+	}
+
+	writer.mu.Lock()
+	for _, key := range keys {
+		delete(writer.SegmentMap, key)
+	}
+	writer.mu.Unlock()
+
+	lgr.Info("CancelSegmentsFromNode %s: cancelled %d segments", sourceNodeName, len(keys))
+
+	return nil
+}
+
+// RunCascadeCancelSub subscribes to the cluster event bus on
+// webWriterStartTopic and cancels every segment belonging to the
+// restarted web-writer. It blocks until stopChan is closed or the
+// socket errors, and is meant to be run in its own goroutine started
+// by NewNimbusioWriter.
+func (writer *nimbusioWriter) RunCascadeCancelSub(lgr logger.Logger,
+	eventBusAddress string, stopChan <-chan struct{}) error {
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return fmt.Errorf("RunCascadeCancelSub NewSocket %s", err)
+	}
+	defer sub.Close()
+
+	if err = sub.Connect(eventBusAddress); err != nil {
+		return fmt.Errorf("RunCascadeCancelSub Connect %s %s", eventBusAddress, err)
+	}
+
+	if err = sub.SetSubscribe(webWriterStartTopic); err != nil {
+		return fmt.Errorf("RunCascadeCancelSub SetSubscribe %s", err)
+	}
+
+	if err = sub.SetRcvtimeo(time.Second); err != nil {
+		return fmt.Errorf("RunCascadeCancelSub SetRcvtimeo %s", err)
+	}
+
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		default:
+		}
+
+		parts, err := sub.RecvMessage(0)
+		if err != nil {
+			// A receive timeout (EAGAIN, from SetRcvtimeo above) only
+			// means no message arrived; go back and check stopChan.
+			if zmq.AsErrno(err) == zmq.Errno(syscall.EAGAIN) {
+				continue
+			}
+			return fmt.Errorf("RunCascadeCancelSub RecvMessage %s", err)
+		}
+
+		if len(parts) != 2 {
+			lgr.Error("RunCascadeCancelSub: malformed message, %d parts", len(parts))
+			continue
+		}
+
+		event, err := parseWebWriterStartEvent(parts[1])
+		if err != nil {
+			lgr.Error("RunCascadeCancelSub: %s", err)
+			continue
+		}
+
+		if err = writer.CancelSegmentsFromNode(lgr, event.SourceNodeName,
+			event.Cutoff); err != nil {
+			lgr.Error("CancelSegmentsFromNode %s", err)
+		}
+	}
+}
+
+// webWriterStartEvent is the decoded body of a web-writer-start
+// message: the node that (re)started, and the timestamp it restarted
+// at, used as the cutoff below which in-flight segments are stale.
+type webWriterStartEvent struct {
+	SourceNodeName string
+	Cutoff         time.Time
+}
+
+// parseWebWriterStartEvent decodes a "web-writer-start" message body of
+// the form "<source-node-name> <timestamp-repr>".
+func parseWebWriterStartEvent(body string) (webWriterStartEvent, error) {
+	fields := strings.SplitN(body, " ", 2)
+	if len(fields) != 2 {
+		return webWriterStartEvent{}, fmt.Errorf(
+			"parseWebWriterStartEvent: malformed body %q", body)
+	}
+
+	cutoff, err := tools.ParseTimestampRepr(fields[1])
+	if err != nil {
+		return webWriterStartEvent{}, fmt.Errorf("parseWebWriterStartEvent ParseTimestampRepr %s", err)
+	}
+
+	return webWriterStartEvent{SourceNodeName: fields[0], Cutoff: cutoff}, nil
+}
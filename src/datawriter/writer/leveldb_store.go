@@ -0,0 +1,712 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"datawriter/msg"
+	"datawriter/types"
+)
+
+// segmentStoreKeyPrefix is the common prefix of every key
+// segmentStoreKey produces, used to iterate all persisted segment rows
+// on open.
+var segmentStoreKeyPrefix = []byte("seg/")
+
+// leveldbStore is a MetadataStore implementation backed by an embedded
+// goleveldb database, for single-node deployments that don't want a
+// Postgres dependency. Rows are gob-encoded under composite keys:
+//
+//	seg/<unifiedID>/<conjoinedPart>/<segmentNum>        -> segmentRow
+//	seq/<unifiedID>/<conjoinedPart>/<segmentNum>/<sequenceNum> -> empty value, written only once ValueFile.Store succeeds
+//	key/<collectionID>/<key>/<timestamp>/<unifiedID>    -> secondary index, value is the seg/ key
+//	conj/<collectionID>/<key>/<unifiedID>                -> conjoinedRow
+//	gap/<unifiedID>/<conjoinedPart>/<segmentNum>/<sequenceNum>/<peerNodeID> -> empty value
+//	tomb/<collectionID>/<key>/<unifiedIDToDestroy>       -> tombstoneRow (unifiedIDToDestroy 0 means "every version of key")
+//
+// leveldbStore does not support real transactions, so WithTx (see
+// leveldbTx) stages row mutations in memory for the duration of fn and
+// only persists them once fn returns nil, under a single mutex held
+// for the whole call. That gives the same commit/rollback guarantee
+// Postgres gives us without requiring an atomic batch across the
+// store's unrelated key prefixes.
+type leveldbStore struct {
+	mu           sync.Mutex
+	db           *leveldb.DB
+	nextSegment  uint64
+	segmentIDMap sync.Map // uint64 segment id -> seg/ store key, for lookups by segment id
+}
+
+// segmentRow is the gob-encoded value stored under a seg/ key.
+type segmentRow struct {
+	SegmentID      uint64
+	CollectionID   uint64
+	Key            string
+	UnifiedID      uint64
+	ConjoinedPart  uint32
+	SegmentNum     uint8
+	Timestamp      time.Time
+	SourceNodeID   uint32
+	HandoffNodeID  uint32
+	Cancelled      bool
+	Finished       bool
+	FileSize       uint64
+	MD5Digest      []byte
+	Adler32        int32
+	MetaData       map[string]string
+}
+
+// conjoinedRow is the gob-encoded value stored under a conj/ key.
+type conjoinedRow struct {
+	CollectionID  uint64
+	Key           string
+	UnifiedID     uint64
+	Timestamp     time.Time
+	HandoffNodeID uint32
+	Aborted       bool
+	Finished      bool
+}
+
+// tombstoneRow is the gob-encoded value stored under a tomb/ key.
+type tombstoneRow struct {
+	CollectionID  uint64
+	Key           string
+	UnifiedID     uint64
+	Timestamp     time.Time
+	SourceNodeID  uint32
+	HandoffNodeID uint32
+}
+
+func newLevelDBStore(repoPath string) (*leveldbStore, error) {
+	dbPath := filepath.Join(repoPath, "metadata.leveldb")
+
+	db, err := leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("newLevelDBStore OpenFile %s %s", dbPath, err)
+	}
+
+	store := &leveldbStore{db: db, nextSegment: 1}
+
+	if err := store.rebuildSegmentIndex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("newLevelDBStore %s", err)
+	}
+
+	return store, nil
+}
+
+// rebuildSegmentIndex scans every persisted seg/ row and seeds
+// nextSegment and segmentIDMap from it. Both fields are otherwise
+// purely in-memory, so without this a restart would start nextSegment
+// back at 1 (colliding with segment ids already on disk) and leave
+// segmentIDMap empty (failing withSegmentID lookups for every segment
+// that was started before the restart).
+func (store *leveldbStore) rebuildSegmentIndex() error {
+	iter := store.db.NewIterator(util.BytesPrefix(segmentStoreKeyPrefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var row segmentRow
+		if err := gob.NewDecoder(bytes.NewReader(iter.Value())).Decode(&row); err != nil {
+			return fmt.Errorf("rebuildSegmentIndex decode segmentRow %s", err)
+		}
+
+		storeKey := make([]byte, len(iter.Key()))
+		copy(storeKey, iter.Key())
+		store.segmentIDMap.Store(row.SegmentID, storeKey)
+
+		if row.SegmentID >= store.nextSegment {
+			store.nextSegment = row.SegmentID + 1
+		}
+	}
+
+	return iter.Error()
+}
+
+func segmentStoreKey(unifiedID uint64, conjoinedPart uint32, segmentNum uint8) []byte {
+	return []byte(fmt.Sprintf("seg/%020d/%010d/%03d", unifiedID, conjoinedPart, segmentNum))
+}
+
+func conjoinedStoreKey(collectionID uint64, key string, unifiedID uint64) []byte {
+	return []byte(fmt.Sprintf("conj/%020d/%s/%020d", collectionID, key, unifiedID))
+}
+
+func listStoreKey(collectionID uint64, key string, timestamp time.Time, unifiedID uint64) []byte {
+	return []byte(fmt.Sprintf("key/%020d/%s/%020d/%020d", collectionID, key,
+		timestamp.UnixNano(), unifiedID))
+}
+
+func gapStoreKey(unifiedID uint64, conjoinedPart uint32, segmentNum uint8,
+	sequenceNum uint64, peerNodeID uint32) []byte {
+	return []byte(fmt.Sprintf("gap/%020d/%010d/%03d/%020d/%010d", unifiedID,
+		conjoinedPart, segmentNum, sequenceNum, peerNodeID))
+}
+
+func tombstoneStoreKey(collectionID uint64, key string, unifiedIDToDestroy uint64) []byte {
+	return []byte(fmt.Sprintf("tomb/%020d/%s/%020d", collectionID, key, unifiedIDToDestroy))
+}
+
+func sequenceStoreKey(unifiedID uint64, conjoinedPart uint32, segmentNum uint8,
+	sequenceNum uint64) []byte {
+	return []byte(fmt.Sprintf("seq/%020d/%010d/%03d/%020d", unifiedID, conjoinedPart,
+		segmentNum, sequenceNum))
+}
+
+func (store *leveldbStore) getSegmentRow(storeKey []byte) (segmentRow, error) {
+	var row segmentRow
+
+	raw, err := store.db.Get(storeKey, nil)
+	if err != nil {
+		return row, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&row); err != nil {
+		return row, fmt.Errorf("leveldbStore decode segmentRow %s", err)
+	}
+
+	return row, nil
+}
+
+func (store *leveldbStore) putSegmentRow(storeKey []byte, row segmentRow) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(row); err != nil {
+		return fmt.Errorf("leveldbStore encode segmentRow %s", err)
+	}
+
+	return store.db.Put(storeKey, buf.Bytes(), nil)
+}
+
+func (store *leveldbStore) NewSegment(segment msg.Segment,
+	sourceNodeID, handoffNodeID uint32) (uint64, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	segmentID := store.nextSegment
+	store.nextSegment++
+
+	row := segmentRow{
+		SegmentID:     segmentID,
+		CollectionID:  segment.CollectionID,
+		Key:           segment.Key,
+		UnifiedID:     segment.UnifiedID,
+		ConjoinedPart: segment.ConjoinedPart,
+		SegmentNum:    segment.SegmentNum,
+		Timestamp:     segment.Timestamp,
+		SourceNodeID:  sourceNodeID,
+		HandoffNodeID: handoffNodeID,
+		MetaData:      make(map[string]string),
+	}
+
+	storeKey := segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	if err := store.putSegmentRow(storeKey, row); err != nil {
+		return 0, fmt.Errorf("leveldbStore.NewSegment %s", err)
+	}
+
+	indexKey := listStoreKey(segment.CollectionID, segment.Key, segment.Timestamp,
+		segment.UnifiedID)
+	if err := store.db.Put(indexKey, storeKey, nil); err != nil {
+		return 0, fmt.Errorf("leveldbStore.NewSegment index %s", err)
+	}
+
+	store.segmentIDMap.Store(segmentID, storeKey)
+
+	return segmentID, nil
+}
+
+// NewSegmentSequence writes a seq/ marker row for this specific
+// sequence. applyStoreSequence only calls this after ValueFile.Store
+// has already succeeded, so the marker's existence is what
+// SequenceExists uses as proof the bytes are durable -- it must not be
+// confused with SegmentExists, which goes true the moment StartSegment
+// commits and says nothing about any sequence having been written yet.
+func (store *leveldbStore) NewSegmentSequence(collectionID, segmentID uint64,
+	sequence msg.Sequence, valueFileID uint32, offset uint64) error {
+
+	storeKeyVal, ok := store.segmentIDMap.Load(segmentID)
+	if !ok {
+		return fmt.Errorf("leveldbStore.NewSegmentSequence: unknown segment id %d", segmentID)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row, err := store.getSegmentRow(storeKeyVal.([]byte))
+	if err != nil {
+		return fmt.Errorf("leveldbStore.NewSegmentSequence %s", err)
+	}
+
+	seqKey := sequenceStoreKey(row.UnifiedID, row.ConjoinedPart, row.SegmentNum,
+		sequence.SequenceNum)
+	if err := store.db.Put(seqKey, nil, nil); err != nil {
+		return fmt.Errorf("leveldbStore.NewSegmentSequence %s", err)
+	}
+
+	return nil
+}
+
+func (store *leveldbStore) withSegment(unifiedID uint64, conjoinedPart uint32,
+	segmentNum uint8, fn func(row *segmentRow) error) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	storeKey := segmentStoreKey(unifiedID, conjoinedPart, segmentNum)
+	row, err := store.getSegmentRow(storeKey)
+	if err != nil {
+		return fmt.Errorf("leveldbStore: segment (%d,%d,%d) not found: %s",
+			unifiedID, conjoinedPart, segmentNum, err)
+	}
+
+	if err := fn(&row); err != nil {
+		return err
+	}
+
+	return store.putSegmentRow(storeKey, row)
+}
+
+func (store *leveldbStore) FinishSegment(segmentID uint64, file msg.File) error {
+	return store.withSegmentID(segmentID, func(row *segmentRow) error {
+		row.Finished = true
+		row.FileSize = file.FileSize
+		row.MD5Digest = file.MD5Digest
+		row.Adler32 = file.Adler32
+		for _, metaEntry := range file.MetaData {
+			row.MetaData[metaEntry.Key] = metaEntry.Value
+		}
+		return nil
+	})
+}
+
+func (store *leveldbStore) CancelSegment(cancel msg.Cancel) error {
+	return store.withSegment(cancel.UnifiedID, cancel.ConjoinedPart, cancel.SegmentNum,
+		func(row *segmentRow) error {
+			row.Cancelled = true
+			return nil
+		})
+}
+
+func (store *leveldbStore) SegmentExists(segment msg.Segment) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	storeKey := segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	if _, err := store.getSegmentRow(storeKey); err != nil {
+		if err == leveldb.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("leveldbStore.SegmentExists %s", err)
+	}
+
+	return true, nil
+}
+
+func (store *leveldbStore) SequenceExists(segment msg.Segment, sequence msg.Sequence) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	seqKey := sequenceStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum,
+		sequence.SequenceNum)
+	if _, err := store.db.Get(seqKey, nil); err != nil {
+		if err == leveldb.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("leveldbStore.SequenceExists %s", err)
+	}
+
+	return true, nil
+}
+
+func (store *leveldbStore) SegmentCancelled(segment msg.Segment) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	storeKey := segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	row, err := store.getSegmentRow(storeKey)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("leveldbStore.SegmentCancelled %s", err)
+	}
+
+	return row.Cancelled, nil
+}
+
+func (store *leveldbStore) LookupSegment(segment msg.Segment) (uint64, uint32, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	storeKey := segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	row, err := store.getSegmentRow(storeKey)
+	if err != nil {
+		return 0, 0, fmt.Errorf("leveldbStore.LookupSegment %s", err)
+	}
+
+	return row.SegmentID, row.SourceNodeID, nil
+}
+
+// RecordReplicationGap records, one row per peer, that peerNodeIDs
+// missed sequenceNum for segment, so an anti-entropy handoff process
+// can scan the gap/ prefix and backfill them. The row's value is empty
+// since the key alone (segment, sequence, peer) is the whole record.
+func (store *leveldbStore) RecordReplicationGap(segment msg.Segment,
+	sequenceNum uint64, peerNodeIDs []uint32) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, peerNodeID := range peerNodeIDs {
+		key := gapStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum,
+			sequenceNum, peerNodeID)
+		if err := store.db.Put(key, nil, nil); err != nil {
+			return fmt.Errorf("leveldbStore.RecordReplicationGap %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (store *leveldbStore) CancelSegmentsFromNode(sourceNodeID uint32, keys []segmentKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Every row goes into one batch so the cancels commit together or
+	// not at all.
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		storeKey := segmentStoreKey(key.UnifiedID, key.ConjoinedPart, key.SegmentNum)
+		row, err := store.getSegmentRow(storeKey)
+		if err != nil {
+			return fmt.Errorf("leveldbStore.CancelSegmentsFromNode %s %s", key, err)
+		}
+		if row.SourceNodeID != sourceNodeID {
+			continue
+		}
+		row.Cancelled = true
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(row); err != nil {
+			return fmt.Errorf("leveldbStore.CancelSegmentsFromNode %s encode %s", key, err)
+		}
+		batch.Put(storeKey, buf.Bytes())
+	}
+
+	if err := store.db.Write(batch, nil); err != nil {
+		return fmt.Errorf("leveldbStore.CancelSegmentsFromNode %s", err)
+	}
+
+	return nil
+}
+
+func (store *leveldbStore) NewMetaData(collectionID, segmentID uint64,
+	key, value string, timestamp time.Time) error {
+	return store.withSegmentID(segmentID, func(row *segmentRow) error {
+		row.MetaData[key] = value
+		return nil
+	})
+}
+
+// withSegmentID looks up the segment with the given id. segmentID is
+// not itself part of the composite key (unifiedID/conjoinedPart/
+// segmentNum is), so FinishSegment and NewMetaData, which are called
+// with only a segmentID, have to look it up via segmentIDMap, which
+// NewSegment populates.
+func (store *leveldbStore) withSegmentID(segmentID uint64,
+	fn func(row *segmentRow) error) error {
+
+	storeKeyVal, ok := store.segmentIDMap.Load(segmentID)
+	if !ok {
+		return fmt.Errorf("leveldbStore: unknown segment id %d", segmentID)
+	}
+	storeKey := storeKeyVal.([]byte)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row, err := store.getSegmentRow(storeKey)
+	if err != nil {
+		return fmt.Errorf("leveldbStore.withSegmentID %s", err)
+	}
+
+	if err := fn(&row); err != nil {
+		return err
+	}
+
+	return store.putSegmentRow(storeKey, row)
+}
+
+// NewTombstone durably records that unifiedIDToDestroy (or, if 0, every
+// version of segment.Key) has been destroyed, under its own tomb/ key so
+// that TombstoneExists has something to consult, and clears the
+// matching conjoined row the same way postgresStore's delete-conjoined*
+// statements do.
+func (store *leveldbStore) NewTombstone(segment msg.Segment, unifiedIDToDestroy uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row := tombstoneRow{
+		CollectionID:  segment.CollectionID,
+		Key:           segment.Key,
+		UnifiedID:     unifiedIDToDestroy,
+		Timestamp:     segment.Timestamp,
+		SourceNodeID:  segment.SourceNodeID,
+		HandoffNodeID: segment.HandoffNodeID,
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(row); err != nil {
+		return fmt.Errorf("leveldbStore.NewTombstone encode %s", err)
+	}
+
+	tombKey := tombstoneStoreKey(segment.CollectionID, segment.Key, unifiedIDToDestroy)
+	if err := store.db.Put(tombKey, buf.Bytes(), nil); err != nil {
+		return fmt.Errorf("leveldbStore.NewTombstone %s", err)
+	}
+
+	conjoinedUnifiedID := unifiedIDToDestroy
+	if conjoinedUnifiedID == 0 {
+		conjoinedUnifiedID = segment.UnifiedID
+	}
+	conjKey := conjoinedStoreKey(segment.CollectionID, segment.Key, conjoinedUnifiedID)
+	if err := store.db.Delete(conjKey, nil); err != nil {
+		return fmt.Errorf("leveldbStore.NewTombstone delete conjoined %s", err)
+	}
+
+	return nil
+}
+
+// TombstoneExists reports whether NewTombstone has already recorded the
+// tombstone segment/unifiedIDToDestroy would write, so WAL replay can
+// skip a DestroyKey that completed before a crash.
+func (store *leveldbStore) TombstoneExists(segment msg.Segment, unifiedIDToDestroy uint64) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	tombKey := tombstoneStoreKey(segment.CollectionID, segment.Key, unifiedIDToDestroy)
+	if _, err := store.db.Get(tombKey, nil); err != nil {
+		if err == leveldb.ErrNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("leveldbStore.TombstoneExists %s", err)
+	}
+
+	return true, nil
+}
+
+func (store *leveldbStore) StartConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var buf bytes.Buffer
+	row := conjoinedRow{
+		CollectionID:  conjoinedEntry.CollectionID,
+		Key:           conjoinedEntry.Key,
+		UnifiedID:     conjoinedEntry.UnifiedID,
+		Timestamp:     conjoinedEntry.Timestamp,
+		HandoffNodeID: conjoinedEntry.HandoffNodeID,
+	}
+	if err := gob.NewEncoder(&buf).Encode(row); err != nil {
+		return fmt.Errorf("leveldbStore.StartConjoined encode %s", err)
+	}
+
+	key := conjoinedStoreKey(conjoinedEntry.CollectionID, conjoinedEntry.Key,
+		conjoinedEntry.UnifiedID)
+	return store.db.Put(key, buf.Bytes(), nil)
+}
+
+func (store *leveldbStore) withConjoined(conjoinedEntry types.ConjoinedEntry,
+	fn func(row *conjoinedRow) error) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := conjoinedStoreKey(conjoinedEntry.CollectionID, conjoinedEntry.Key,
+		conjoinedEntry.UnifiedID)
+
+	raw, err := store.db.Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("leveldbStore.withConjoined %s", err)
+	}
+
+	var row conjoinedRow
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&row); err != nil {
+		return fmt.Errorf("leveldbStore.withConjoined decode %s", err)
+	}
+
+	if err := fn(&row); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(row); err != nil {
+		return fmt.Errorf("leveldbStore.withConjoined encode %s", err)
+	}
+
+	return store.db.Put(key, buf.Bytes(), nil)
+}
+
+// getConjoinedRow returns conjoinedEntry's conjoinedRow and whether it
+// was found, treating leveldb.ErrNotFound as "not found" rather than an
+// error, for the ConjoinedExists/Aborted/Finished idempotency checks.
+func (store *leveldbStore) getConjoinedRow(conjoinedEntry types.ConjoinedEntry) (conjoinedRow, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := conjoinedStoreKey(conjoinedEntry.CollectionID, conjoinedEntry.Key, conjoinedEntry.UnifiedID)
+	raw, err := store.db.Get(key, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return conjoinedRow{}, false, nil
+		}
+		return conjoinedRow{}, false, fmt.Errorf("leveldbStore.getConjoinedRow %s", err)
+	}
+
+	var row conjoinedRow
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&row); err != nil {
+		return conjoinedRow{}, false, fmt.Errorf("leveldbStore.getConjoinedRow decode %s", err)
+	}
+
+	return row, true, nil
+}
+
+func (store *leveldbStore) ConjoinedExists(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	_, found, err := store.getConjoinedRow(conjoinedEntry)
+	return found, err
+}
+
+func (store *leveldbStore) ConjoinedAborted(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	row, found, err := store.getConjoinedRow(conjoinedEntry)
+	if err != nil || !found {
+		return false, err
+	}
+	return row.Aborted, nil
+}
+
+func (store *leveldbStore) ConjoinedFinished(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	row, found, err := store.getConjoinedRow(conjoinedEntry)
+	if err != nil || !found {
+		return false, err
+	}
+	return row.Finished, nil
+}
+
+func (store *leveldbStore) AbortConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	return store.withConjoined(conjoinedEntry, func(row *conjoinedRow) error {
+		row.Aborted = true
+		return nil
+	})
+}
+
+func (store *leveldbStore) FinishConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	return store.withConjoined(conjoinedEntry, func(row *conjoinedRow) error {
+		row.Finished = true
+		return nil
+	})
+}
+
+// leveldbTx is the MetadataTx leveldbStore hands to WithTx's fn. Unlike
+// postgresTx, it does not write through to the database as fn runs:
+// every FinishSegment/NewMetaData call stages its change against an
+// in-memory copy of the affected segment row, and WithTx only persists
+// those copies once fn returns nil. This is what makes leveldbStore's
+// rollback-on-error guarantee real, rather than leaving a segment
+// finished with some, but not all, of its metadata rows if a later
+// call in the same fn fails.
+type leveldbTx struct {
+	store  *leveldbStore
+	staged map[uint64]*segmentRow
+	keys   map[uint64][]byte
+}
+
+// rowFor returns the staged row for segmentID, fetching and copying it
+// from the database the first time it is touched within this tx.
+func (tx *leveldbTx) rowFor(segmentID uint64) (*segmentRow, error) {
+	if row, ok := tx.staged[segmentID]; ok {
+		return row, nil
+	}
+
+	storeKeyVal, ok := tx.store.segmentIDMap.Load(segmentID)
+	if !ok {
+		return nil, fmt.Errorf("leveldbStore: unknown segment id %d", segmentID)
+	}
+	storeKey := storeKeyVal.([]byte)
+
+	row, err := tx.store.getSegmentRow(storeKey)
+	if err != nil {
+		return nil, fmt.Errorf("leveldbTx.rowFor %s", err)
+	}
+
+	metaData := make(map[string]string, len(row.MetaData))
+	for k, v := range row.MetaData {
+		metaData[k] = v
+	}
+	row.MetaData = metaData
+
+	tx.staged[segmentID] = &row
+	tx.keys[segmentID] = storeKey
+
+	return &row, nil
+}
+
+func (tx *leveldbTx) FinishSegment(segmentID uint64, file msg.File) error {
+	row, err := tx.rowFor(segmentID)
+	if err != nil {
+		return err
+	}
+
+	row.Finished = true
+	row.FileSize = file.FileSize
+	row.MD5Digest = file.MD5Digest
+	row.Adler32 = file.Adler32
+	for _, metaEntry := range file.MetaData {
+		row.MetaData[metaEntry.Key] = metaEntry.Value
+	}
+
+	return nil
+}
+
+func (tx *leveldbTx) NewMetaData(collectionID, segmentID uint64,
+	key, value string, timestamp time.Time) error {
+	row, err := tx.rowFor(segmentID)
+	if err != nil {
+		return err
+	}
+
+	row.MetaData[key] = value
+
+	return nil
+}
+
+func (store *leveldbStore) WithTx(fn func(tx MetadataTx) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	tx := &leveldbTx{
+		store:  store,
+		staged: make(map[uint64]*segmentRow),
+		keys:   make(map[uint64][]byte),
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for segmentID, row := range tx.staged {
+		if err := store.putSegmentRow(tx.keys[segmentID], *row); err != nil {
+			return fmt.Errorf("leveldbStore.WithTx %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (store *leveldbStore) Close() error {
+	return store.db.Close()
+}
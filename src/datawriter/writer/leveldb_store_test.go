@@ -0,0 +1,204 @@
+package writer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"datawriter/msg"
+	"datawriter/types"
+)
+
+func TestLevelDBStoreWithTxRollsBackOnError(t *testing.T) {
+	store, err := newLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+	defer store.Close()
+
+	segment := msg.Segment{UnifiedID: 1, ConjoinedPart: 0, SegmentNum: 1}
+	segmentID, err := store.NewSegment(segment, 1, 0)
+	if err != nil {
+		t.Fatalf("NewSegment() error = %s", err)
+	}
+
+	failure := errors.New("boom")
+	err = store.WithTx(func(tx MetadataTx) error {
+		if err := tx.FinishSegment(segmentID, msg.File{FileSize: 100}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("WithTx() error = %v, want %v", err, failure)
+	}
+
+	row, err := store.getSegmentRow(segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart,
+		segment.SegmentNum))
+	if err != nil {
+		t.Fatalf("getSegmentRow() error = %s", err)
+	}
+	if row.Finished {
+		t.Errorf("segment row was Finished after a WithTx that returned an error")
+	}
+}
+
+func TestLevelDBStoreWithTxCommitsOnSuccess(t *testing.T) {
+	store, err := newLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+	defer store.Close()
+
+	segment := msg.Segment{UnifiedID: 2, ConjoinedPart: 0, SegmentNum: 1}
+	segmentID, err := store.NewSegment(segment, 1, 0)
+	if err != nil {
+		t.Fatalf("NewSegment() error = %s", err)
+	}
+
+	err = store.WithTx(func(tx MetadataTx) error {
+		if err := tx.FinishSegment(segmentID, msg.File{FileSize: 100}); err != nil {
+			return err
+		}
+		return tx.NewMetaData(segment.CollectionID, segmentID, "k", "v", time.Time{})
+	})
+	if err != nil {
+		t.Fatalf("WithTx() error = %s", err)
+	}
+
+	row, err := store.getSegmentRow(segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart,
+		segment.SegmentNum))
+	if err != nil {
+		t.Fatalf("getSegmentRow() error = %s", err)
+	}
+	if !row.Finished || row.MetaData["k"] != "v" {
+		t.Errorf("got row %+v, want Finished=true and MetaData[k]=v", row)
+	}
+}
+
+func TestLevelDBStoreRebuildsSegmentIndexOnReopen(t *testing.T) {
+	dbDir := t.TempDir()
+
+	store, err := newLevelDBStore(dbDir)
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+
+	segment := msg.Segment{UnifiedID: 3, ConjoinedPart: 0, SegmentNum: 1}
+	segmentID, err := store.NewSegment(segment, 1, 0)
+	if err != nil {
+		t.Fatalf("NewSegment() error = %s", err)
+	}
+	store.Close()
+
+	reopened, err := newLevelDBStore(dbDir)
+	if err != nil {
+		t.Fatalf("newLevelDBStore() (reopen) error = %s", err)
+	}
+	defer reopened.Close()
+
+	if reopened.nextSegment <= segmentID {
+		t.Errorf("nextSegment = %d, want > %d after reopen", reopened.nextSegment, segmentID)
+	}
+
+	if err := reopened.FinishSegment(segmentID, msg.File{FileSize: 100}); err != nil {
+		t.Fatalf("FinishSegment() after reopen error = %s", err)
+	}
+
+	row, err := reopened.getSegmentRow(segmentStoreKey(segment.UnifiedID, segment.ConjoinedPart,
+		segment.SegmentNum))
+	if err != nil {
+		t.Fatalf("getSegmentRow() error = %s", err)
+	}
+	if !row.Finished {
+		t.Errorf("segment row was not Finished after FinishSegment on a reopened store")
+	}
+}
+
+func TestLevelDBStoreRecordReplicationGap(t *testing.T) {
+	store, err := newLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+	defer store.Close()
+
+	segment := msg.Segment{UnifiedID: 4, ConjoinedPart: 0, SegmentNum: 1}
+	if err := store.RecordReplicationGap(segment, 7, []uint32{2, 3}); err != nil {
+		t.Fatalf("RecordReplicationGap() error = %s", err)
+	}
+
+	for _, peerNodeID := range []uint32{2, 3} {
+		key := gapStoreKey(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum, 7, peerNodeID)
+		if _, err := store.db.Get(key, nil); err != nil {
+			t.Errorf("gap row for peer %d not found: %s", peerNodeID, err)
+		}
+	}
+}
+
+func TestLevelDBStoreSequenceExistsIsFalseUntilNewSegmentSequence(t *testing.T) {
+	store, err := newLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+	defer store.Close()
+
+	segment := msg.Segment{UnifiedID: 6, ConjoinedPart: 0, SegmentNum: 1}
+	segmentID, err := store.NewSegment(segment, 1, 0)
+	if err != nil {
+		t.Fatalf("NewSegment() error = %s", err)
+	}
+
+	sequence := msg.Sequence{SequenceNum: 0}
+	exists, err := store.SequenceExists(segment, sequence)
+	if err != nil {
+		t.Fatalf("SequenceExists() error = %s", err)
+	}
+	if exists {
+		t.Errorf("SequenceExists() = true before any StoreSequence, want false " +
+			"(a fresh segment must not look like an already-applied retry)")
+	}
+
+	if err := store.NewSegmentSequence(segment.CollectionID, segmentID, sequence, 1, 0); err != nil {
+		t.Fatalf("NewSegmentSequence() error = %s", err)
+	}
+
+	exists, err = store.SequenceExists(segment, sequence)
+	if err != nil {
+		t.Fatalf("SequenceExists() error = %s", err)
+	}
+	if !exists {
+		t.Errorf("SequenceExists() = false after NewSegmentSequence, want true")
+	}
+}
+
+func TestLevelDBStoreNewTombstoneRecordsTombstoneAndClearsConjoined(t *testing.T) {
+	store, err := newLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newLevelDBStore() error = %s", err)
+	}
+	defer store.Close()
+
+	segment := msg.Segment{CollectionID: 1, Key: "a-key", UnifiedID: 5}
+	conjoinedEntry := types.ConjoinedEntry{CollectionID: 1, Key: "a-key", UnifiedID: 5}
+	if err := store.StartConjoined(conjoinedEntry); err != nil {
+		t.Fatalf("StartConjoined() error = %s", err)
+	}
+
+	if err := store.NewTombstone(segment, 0); err != nil {
+		t.Fatalf("NewTombstone() error = %s", err)
+	}
+
+	exists, err := store.TombstoneExists(segment, 0)
+	if err != nil {
+		t.Fatalf("TombstoneExists() error = %s", err)
+	}
+	if !exists {
+		t.Errorf("TombstoneExists() = false, want true after NewTombstone")
+	}
+
+	if _, err := store.db.Get(conjoinedStoreKey(segment.CollectionID, segment.Key, segment.UnifiedID), nil); err != leveldb.ErrNotFound {
+		t.Errorf("conjoined row still present after NewTombstone, err = %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package writer
+
+import (
+	"time"
+
+	"datawriter/msg"
+	"datawriter/types"
+)
+
+// MetadataStore abstracts the durable bookkeeping a NimbusioWriter
+// needs for segments, sequences, tombstones and conjoined archives, so
+// that the same NimbusioWriter logic can run against either Postgres
+// (the cluster deployment) or an embedded, dependency-free store (a
+// single-node deployment). Every method here corresponds to one of the
+// SQL statements the writer used to run directly against
+// nodedb.Stmts.
+type MetadataStore interface {
+
+	// NewSegment records the start of a new segment and returns its
+	// store-assigned segment id.
+	NewSegment(segment msg.Segment, sourceNodeID, handoffNodeID uint32) (uint64, error)
+
+	// NewSegmentSequence records one chunk of segment data at the given
+	// value-file offset.
+	NewSegmentSequence(collectionID, segmentID uint64, sequence msg.Sequence,
+		valueFileID uint32, offset uint64) error
+
+	// FinishSegment marks segmentID complete with the given file
+	// metadata.
+	FinishSegment(segmentID uint64, file msg.File) error
+
+	// CancelSegment marks the segment identified by cancel as
+	// cancelled.
+	CancelSegment(cancel msg.Cancel) error
+
+	// CancelSegmentsFromNode marks every segment in keys as cancelled,
+	// as a single transaction, for a web-writer restart cascade-cancel.
+	CancelSegmentsFromNode(sourceNodeID uint32, keys []segmentKey) error
+
+	// SegmentExists reports whether segment's new-segment row has
+	// already been committed. WAL replay uses this to skip a
+	// StartSegment that completed before a crash, and to skip a
+	// FinishSegment whose segment was never started.
+	SegmentExists(segment msg.Segment) (bool, error)
+
+	// SequenceExists reports whether sequence's new-segment-sequence
+	// row has already been committed for segment, for the same reason.
+	SequenceExists(segment msg.Segment, sequence msg.Sequence) (bool, error)
+
+	// SegmentCancelled reports whether segment has already been marked
+	// cancelled, so WAL replay can skip a CancelSegment that completed
+	// before a crash.
+	SegmentCancelled(segment msg.Segment) (bool, error)
+
+	// TombstoneExists reports whether the tombstone NewTombstone(segment,
+	// unifiedIDToDestroy) would write has already been committed, so WAL
+	// replay can skip a DestroyKey that completed before a crash.
+	TombstoneExists(segment msg.Segment, unifiedIDToDestroy uint64) (bool, error)
+
+	// ConjoinedExists reports whether conjoinedEntry's StartConjoined row
+	// has already been committed, so WAL replay can skip a
+	// StartConjoinedArchive that completed before a crash.
+	ConjoinedExists(conjoinedEntry types.ConjoinedEntry) (bool, error)
+
+	// ConjoinedAborted reports whether conjoinedEntry has already been
+	// marked aborted, so WAL replay can skip an AbortConjoinedArchive
+	// that completed before a crash.
+	ConjoinedAborted(conjoinedEntry types.ConjoinedEntry) (bool, error)
+
+	// ConjoinedFinished reports whether conjoinedEntry has already been
+	// marked finished, so WAL replay can skip a FinishConjoinedArchive
+	// that completed before a crash.
+	ConjoinedFinished(conjoinedEntry types.ConjoinedEntry) (bool, error)
+
+	// LookupSegment returns the store-assigned segment id and source
+	// node id for an already-committed segment, so WAL replay can
+	// repopulate SegmentMap for a StartSegment it is skipping.
+	LookupSegment(segment msg.Segment) (segmentID uint64, sourceNodeID uint32, err error)
+
+	// RecordReplicationGap durably records that peerNodeIDs did not ack
+	// sequenceNum for segment, so an anti-entropy handoff process can
+	// later find and backfill them.
+	RecordReplicationGap(segment msg.Segment, sequenceNum uint64, peerNodeIDs []uint32) error
+
+	// NewMetaData attaches a single user metadata key/value pair to a
+	// segment.
+	NewMetaData(collectionID, segmentID uint64, key, value string,
+		timestamp time.Time) error
+
+	// NewTombstone records a tombstone for segment, optionally scoped
+	// to a single unifiedIDToDestroy (0 means "destroy every version of
+	// the key"), and clears any matching conjoined rows.
+	NewTombstone(segment msg.Segment, unifiedIDToDestroy uint64) error
+
+	// StartConjoined, AbortConjoined and FinishConjoined record the
+	// lifecycle of a conjoined archive.
+	StartConjoined(conjoinedEntry types.ConjoinedEntry) error
+	AbortConjoined(conjoinedEntry types.ConjoinedEntry) error
+	FinishConjoined(conjoinedEntry types.ConjoinedEntry) error
+
+	// WithTx runs fn against a transaction-scoped view of the store,
+	// committing on a nil return and rolling back otherwise. It is used
+	// to group the FinishSegment row with its NewMetaData rows so a
+	// reader never observes one without the other.
+	WithTx(fn func(tx MetadataTx) error) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// MetadataTx is the subset of MetadataStore that makes sense to call
+// inside WithTx.
+type MetadataTx interface {
+	FinishSegment(segmentID uint64, file msg.File) error
+	NewMetaData(collectionID, segmentID uint64, key, value string,
+		timestamp time.Time) error
+}
+
+// newMetadataStore selects a MetadataStore implementation based on
+// NIMBUS_IO_METADATA_BACKEND ("postgres", the default, or "leveldb").
+func newMetadataStore(backend, repoPath string) (MetadataStore, error) {
+	switch backend {
+	case "", "postgres":
+		return newPostgresStore(), nil
+	case "leveldb":
+		return newLevelDBStore(repoPath)
+	default:
+		return nil, errUnknownMetadataBackend(backend)
+	}
+}
+
+type errUnknownMetadataBackend string
+
+func (e errUnknownMetadataBackend) Error() string {
+	return "unknown NIMBUS_IO_METADATA_BACKEND '" + string(e) + "'"
+}
@@ -0,0 +1,475 @@
+package writer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"datawriter/msg"
+	"datawriter/nodedb"
+	"datawriter/types"
+)
+
+// postgresStore is the original MetadataStore implementation: every
+// method is a thin wrapper around one of the prepared statements in
+// nodedb.Stmts.
+type postgresStore struct{}
+
+func newPostgresStore() *postgresStore {
+	return &postgresStore{}
+}
+
+func (store *postgresStore) NewSegment(segment msg.Segment,
+	sourceNodeID, handoffNodeID uint32) (uint64, error) {
+	var segmentID uint64
+	var row *sql.Row
+
+	if handoffNodeID > 0 {
+		stmt := nodedb.Stmts["new-segment-for-handoff"]
+		row = stmt.QueryRow(
+			segment.CollectionID,
+			segment.Key,
+			segment.UnifiedID,
+			segment.Timestamp,
+			segment.SegmentNum,
+			segment.ConjoinedPart,
+			sourceNodeID,
+			handoffNodeID)
+	} else {
+		stmt := nodedb.Stmts["new-segment"]
+		row = stmt.QueryRow(
+			segment.CollectionID,
+			segment.Key,
+			segment.UnifiedID,
+			segment.Timestamp,
+			segment.SegmentNum,
+			segment.ConjoinedPart,
+			sourceNodeID)
+	}
+
+	if err := row.Scan(&segmentID); err != nil {
+		return 0, fmt.Errorf("postgresStore.NewSegment %s", err)
+	}
+
+	return segmentID, nil
+}
+
+func (store *postgresStore) NewSegmentSequence(collectionID, segmentID uint64,
+	sequence msg.Sequence, valueFileID uint32, offset uint64) error {
+
+	stmt := nodedb.Stmts["new-segment-sequence"]
+	_, err := stmt.Exec(
+		collectionID,
+		segmentID,
+		sequence.ZfecPaddingSize,
+		valueFileID,
+		sequence.SequenceNum,
+		offset,
+		sequence.SegmentSize,
+		sequence.MD5Digest,
+		sequence.Adler32)
+
+	if err != nil {
+		return fmt.Errorf("new-segment-sequence %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) FinishSegment(segmentID uint64, file msg.File) error {
+	stmt := nodedb.Stmts["finish-segment"]
+	_, err := stmt.Exec(file.FileSize, file.Adler32, file.MD5Digest, segmentID)
+	if err != nil {
+		return fmt.Errorf("finish-segment %s", err)
+	}
+	return nil
+}
+
+func (store *postgresStore) CancelSegment(cancel msg.Cancel) error {
+	stmt := nodedb.Stmts["cancel-segment"]
+	_, err := stmt.Exec(cancel.UnifiedID, cancel.ConjoinedPart, cancel.SegmentNum)
+	if err != nil {
+		return fmt.Errorf("cancel-segment %s", err)
+	}
+	return nil
+}
+
+func (store *postgresStore) SegmentExists(segment msg.Segment) (bool, error) {
+	// Reuse the same query LookupSegment runs: a count over
+	// segment_sequence answers "has any data been stored for this
+	// segment", not "does the segment's own new-segment row exist",
+	// and WAL replay needs the latter to skip a StartSegment that
+	// committed but crashed before its first StoreSequence.
+	stmt := nodedb.Stmts["segment-id-and-source-node"]
+	var segmentID uint64
+	var sourceNodeID uint32
+	row := stmt.QueryRow(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	switch err := row.Scan(&segmentID, &sourceNodeID); err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	default:
+		return false, fmt.Errorf("segment-id-and-source-node %s", err)
+	}
+}
+
+func (store *postgresStore) SequenceExists(segment msg.Segment, sequence msg.Sequence) (bool, error) {
+	stmt := nodedb.Stmts["segment-sequence-exists"]
+	var count int
+	row := stmt.QueryRow(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum,
+		sequence.SequenceNum)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("segment-sequence-exists %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) SegmentCancelled(segment msg.Segment) (bool, error) {
+	stmt := nodedb.Stmts["segment-cancelled"]
+	var count int
+	row := stmt.QueryRow(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("segment-cancelled %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) TombstoneExists(segment msg.Segment, unifiedIDToDestroy uint64) (bool, error) {
+	var row *sql.Row
+	var count int
+
+	if unifiedIDToDestroy > 0 {
+		stmt := nodedb.Stmts["tombstone-exists-for-unified-id"]
+		row = stmt.QueryRow(segment.CollectionID, segment.Key, segment.Timestamp, unifiedIDToDestroy)
+	} else {
+		stmt := nodedb.Stmts["tombstone-exists"]
+		row = stmt.QueryRow(segment.CollectionID, segment.Key, segment.Timestamp)
+	}
+
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("tombstone-exists %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) ConjoinedExists(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	stmt := nodedb.Stmts["conjoined-exists"]
+	var count int
+	row := stmt.QueryRow(conjoinedEntry.CollectionID, conjoinedEntry.Key, conjoinedEntry.UnifiedID)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("conjoined-exists %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) ConjoinedAborted(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	stmt := nodedb.Stmts["conjoined-aborted"]
+	var count int
+	row := stmt.QueryRow(conjoinedEntry.CollectionID, conjoinedEntry.Key, conjoinedEntry.UnifiedID)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("conjoined-aborted %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) ConjoinedFinished(conjoinedEntry types.ConjoinedEntry) (bool, error) {
+	stmt := nodedb.Stmts["conjoined-finished"]
+	var count int
+	row := stmt.QueryRow(conjoinedEntry.CollectionID, conjoinedEntry.Key, conjoinedEntry.UnifiedID)
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("conjoined-finished %s", err)
+	}
+	return count > 0, nil
+}
+
+func (store *postgresStore) LookupSegment(segment msg.Segment) (uint64, uint32, error) {
+	stmt := nodedb.Stmts["segment-id-and-source-node"]
+	var segmentID uint64
+	var sourceNodeID uint32
+	row := stmt.QueryRow(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum)
+	if err := row.Scan(&segmentID, &sourceNodeID); err != nil {
+		return 0, 0, fmt.Errorf("segment-id-and-source-node %s", err)
+	}
+	return segmentID, sourceNodeID, nil
+}
+
+func (store *postgresStore) RecordReplicationGap(segment msg.Segment,
+	sequenceNum uint64, peerNodeIDs []uint32) error {
+
+	tx, err := nodedb.NodeDB.Begin()
+	if err != nil {
+		return fmt.Errorf("postgresStore.RecordReplicationGap Begin %s", err)
+	}
+
+	stmt := tx.Stmt(nodedb.Stmts["record-replication-gap"])
+	for _, peerNodeID := range peerNodeIDs {
+		if _, err = stmt.Exec(segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum,
+			sequenceNum, peerNodeID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record-replication-gap %s", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("postgresStore.RecordReplicationGap Commit %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) CancelSegmentsFromNode(sourceNodeID uint32, keys []segmentKey) error {
+	tx, err := nodedb.NodeDB.Begin()
+	if err != nil {
+		return fmt.Errorf("postgresStore.CancelSegmentsFromNode Begin %s", err)
+	}
+
+	stmt := tx.Stmt(nodedb.Stmts["cancel-segments-from-node"])
+	for _, key := range keys {
+		if _, err = stmt.Exec(key.UnifiedID, key.ConjoinedPart, key.SegmentNum,
+			sourceNodeID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("cancel-segments-from-node %s %s", key, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("postgresStore.CancelSegmentsFromNode Commit %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) NewMetaData(collectionID, segmentID uint64,
+	key, value string, timestamp time.Time) error {
+
+	stmt := nodedb.Stmts["new-meta-data"]
+	_, err := stmt.Exec(collectionID, segmentID, key, value, timestamp)
+	if err != nil {
+		return fmt.Errorf("new-meta-data %s", err)
+	}
+	return nil
+}
+
+func (store *postgresStore) NewTombstone(segment msg.Segment,
+	unifiedIDToDestroy uint64) error {
+	var err error
+
+	if unifiedIDToDestroy > 0 {
+		if segment.HandoffNodeID > 0 {
+			stmt := nodedb.Stmts["new-tombstone-for-unified-id-for-handoff"]
+			_, err = stmt.Exec(
+				segment.CollectionID,
+				segment.Key,
+				segment.UnifiedID,
+				segment.Timestamp,
+				segment.SegmentNum,
+				unifiedIDToDestroy,
+				segment.SourceNodeID,
+				segment.HandoffNodeID)
+			if err != nil {
+				return fmt.Errorf("new-tombstone-for-unified-id-for-handoff %d %s",
+					unifiedIDToDestroy, err)
+			}
+		} else {
+			stmt := nodedb.Stmts["new-tombstone-for-unified-id"]
+			_, err = stmt.Exec(
+				segment.CollectionID,
+				segment.Key,
+				segment.UnifiedID,
+				segment.Timestamp,
+				segment.SegmentNum,
+				unifiedIDToDestroy,
+				segment.SourceNodeID,
+				segment.HandoffNodeID)
+			if err != nil {
+				return fmt.Errorf("new-tombstone-for-unified-id %d %s",
+					unifiedIDToDestroy, err)
+			}
+		}
+
+		stmt := nodedb.Stmts["delete-conjoined-for-unified-id"]
+		_, err = stmt.Exec(segment.Timestamp, segment.CollectionID, segment.Key,
+			unifiedIDToDestroy)
+		if err != nil {
+			return fmt.Errorf("delete-conjoined-for-unified-id %d %s",
+				unifiedIDToDestroy, err)
+		}
+
+		return nil
+	}
+
+	if segment.HandoffNodeID > 0 {
+		stmt := nodedb.Stmts["new-tombstone-for-handoff"]
+		_, err = stmt.Exec(
+			segment.CollectionID,
+			segment.Key,
+			segment.UnifiedID,
+			segment.Timestamp,
+			segment.SegmentNum,
+			segment.SourceNodeID,
+			segment.HandoffNodeID)
+		if err != nil {
+			return fmt.Errorf("new-tombstone-for-handoff %s", err)
+		}
+	} else {
+		stmt := nodedb.Stmts["new-tombstone"]
+		_, err = stmt.Exec(
+			segment.CollectionID,
+			segment.Key,
+			segment.UnifiedID,
+			segment.Timestamp,
+			segment.SegmentNum,
+			segment.SourceNodeID)
+		if err != nil {
+			return fmt.Errorf("new-tombstone %s", err)
+		}
+	}
+
+	stmt := nodedb.Stmts["delete-conjoined"]
+	_, err = stmt.Exec(segment.Timestamp, segment.CollectionID, segment.Key,
+		segment.UnifiedID)
+	if err != nil {
+		return fmt.Errorf("delete-conjoined %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) StartConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	var err error
+
+	if conjoinedEntry.HandoffNodeID > 0 {
+		stmt := nodedb.Stmts["start-conjoined-for-handoff"]
+		_, err = stmt.Exec(
+			conjoinedEntry.CollectionID,
+			conjoinedEntry.Key,
+			conjoinedEntry.UnifiedID,
+			conjoinedEntry.Timestamp,
+			conjoinedEntry.HandoffNodeID)
+		if err != nil {
+			return fmt.Errorf("start-conjoined-for-handoff %s", err)
+		}
+		return nil
+	}
+
+	stmt := nodedb.Stmts["start-conjoined"]
+	_, err = stmt.Exec(
+		conjoinedEntry.CollectionID,
+		conjoinedEntry.Key,
+		conjoinedEntry.UnifiedID,
+		conjoinedEntry.Timestamp)
+	if err != nil {
+		return fmt.Errorf("start-conjoined %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) AbortConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	var err error
+
+	if conjoinedEntry.HandoffNodeID > 0 {
+		stmt := nodedb.Stmts["abort-conjoined-for-handoff"]
+		_, err = stmt.Exec(
+			conjoinedEntry.Timestamp,
+			conjoinedEntry.CollectionID,
+			conjoinedEntry.Key,
+			conjoinedEntry.UnifiedID,
+			conjoinedEntry.HandoffNodeID)
+		if err != nil {
+			return fmt.Errorf("abort-conjoined-for-handoff %s", err)
+		}
+		return nil
+	}
+
+	stmt := nodedb.Stmts["abort-conjoined"]
+	_, err = stmt.Exec(
+		conjoinedEntry.Timestamp,
+		conjoinedEntry.CollectionID,
+		conjoinedEntry.Key,
+		conjoinedEntry.UnifiedID)
+	if err != nil {
+		return fmt.Errorf("abort-conjoined %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) FinishConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	var err error
+
+	if conjoinedEntry.HandoffNodeID > 0 {
+		stmt := nodedb.Stmts["finish-conjoined-for-handoff"]
+		_, err = stmt.Exec(
+			conjoinedEntry.Timestamp,
+			conjoinedEntry.CollectionID,
+			conjoinedEntry.Key,
+			conjoinedEntry.UnifiedID,
+			conjoinedEntry.HandoffNodeID)
+		if err != nil {
+			return fmt.Errorf("finish-conjoined-for-handoff %s", err)
+		}
+		return nil
+	}
+
+	stmt := nodedb.Stmts["finish-conjoined"]
+	_, err = stmt.Exec(
+		conjoinedEntry.Timestamp,
+		conjoinedEntry.CollectionID,
+		conjoinedEntry.Key,
+		conjoinedEntry.UnifiedID)
+	if err != nil {
+		return fmt.Errorf("finish-conjoined %s", err)
+	}
+
+	return nil
+}
+
+// postgresTx implements MetadataTx against a single Postgres
+// transaction, so FinishSegment and its NewMetaData rows commit or
+// roll back together.
+type postgresTx struct {
+	tx *sql.Tx
+}
+
+func (tx *postgresTx) FinishSegment(segmentID uint64, file msg.File) error {
+	stmt := tx.tx.Stmt(nodedb.Stmts["finish-segment"])
+	_, err := stmt.Exec(file.FileSize, file.Adler32, file.MD5Digest, segmentID)
+	if err != nil {
+		return fmt.Errorf("finish-segment %s", err)
+	}
+	return nil
+}
+
+func (tx *postgresTx) NewMetaData(collectionID, segmentID uint64,
+	key, value string, timestamp time.Time) error {
+	stmt := tx.tx.Stmt(nodedb.Stmts["new-meta-data"])
+	_, err := stmt.Exec(collectionID, segmentID, key, value, timestamp)
+	if err != nil {
+		return fmt.Errorf("new-meta-data %s", err)
+	}
+	return nil
+}
+
+func (store *postgresStore) WithTx(fn func(tx MetadataTx) error) error {
+	dbTx, err := nodedb.NodeDB.Begin()
+	if err != nil {
+		return fmt.Errorf("postgresStore.WithTx Begin %s", err)
+	}
+
+	if err = fn(&postgresTx{tx: dbTx}); err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	if err = dbTx.Commit(); err != nil {
+		return fmt.Errorf("postgresStore.WithTx Commit %s", err)
+	}
+
+	return nil
+}
+
+func (store *postgresStore) Close() error {
+	return nil
+}
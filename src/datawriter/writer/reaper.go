@@ -0,0 +1,92 @@
+package writer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"tools"
+
+	"datawriter/logger"
+	"datawriter/msg"
+)
+
+const (
+	defaultSegmentIdleCheckInterval = 60 * time.Second
+	defaultSegmentIdleTimeout       = 10 * time.Minute
+)
+
+// Stats is a snapshot of writer state useful for observability.
+type Stats struct {
+	ActiveSegmentCount int
+}
+
+// Stats returns the current count of in-flight segments.
+func (writer *nimbusioWriter) Stats() Stats {
+	writer.mu.RLock()
+	defer writer.mu.RUnlock()
+
+	return Stats{ActiveSegmentCount: len(writer.SegmentMap)}
+}
+
+// durationFromEnv reads a time.Duration-as-seconds environment
+// variable, falling back to fallback if it is unset.
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	seconds, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s'", name, raw)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// RunIdleSegmentReaper scans SegmentMap every checkInterval and cancels
+// any entry whose LastActionTime is older than idleTimeout, using the
+// same code path as CancelSegment. It runs until stopChan is closed,
+// and is meant to be started in its own goroutine by NewNimbusioWriter.
+func (writer *nimbusioWriter) RunIdleSegmentReaper(lgr logger.Logger,
+	checkInterval, idleTimeout time.Duration, stopChan <-chan struct{}) {
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			writer.reapIdleSegments(lgr, idleTimeout)
+		}
+	}
+}
+
+func (writer *nimbusioWriter) reapIdleSegments(lgr logger.Logger, idleTimeout time.Duration) {
+	deadline := tools.Timestamp().Add(-idleTimeout)
+
+	writer.mu.RLock()
+	var stale []segmentKey
+	for key, entry := range writer.SegmentMap {
+		if entry.LastActionTime.Before(deadline) {
+			stale = append(stale, key)
+		}
+	}
+	writer.mu.RUnlock()
+
+	for _, key := range stale {
+		lgr.Info("reaping idle segment %s", key)
+		cancel := msg.Cancel{
+			UnifiedID:     key.UnifiedID,
+			ConjoinedPart: key.ConjoinedPart,
+			SegmentNum:    key.SegmentNum,
+		}
+		if err := writer.CancelSegment(lgr, cancel); err != nil {
+			lgr.Error("reapIdleSegments: CancelSegment %s: %s", key, err)
+		}
+	}
+}
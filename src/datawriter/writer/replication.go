@@ -0,0 +1,413 @@
+package writer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"tools"
+
+	"datawriter/msg"
+)
+
+// ReplicationPolicy controls how StoreSequence durability is extended
+// beyond the local node.
+type ReplicationPolicy string
+
+const (
+	// ReplicationNone relies solely on the local WAL and anti-entropy
+	// handoff, as nimbusioWriter always has.
+	ReplicationNone ReplicationPolicy = "none"
+
+	// ReplicationAsync mirrors writes to peers in the background
+	// without delaying the local StoreSequence response.
+	ReplicationAsync ReplicationPolicy = "async"
+
+	// ReplicationQuorum waits for acks from a majority of peers before
+	// StoreSequence returns success.
+	ReplicationQuorum ReplicationPolicy = "quorum"
+)
+
+const (
+	defaultReplicationDialTimeout = 5 * time.Second
+	defaultReplicationAckTimeout  = 2 * time.Second
+	defaultReplicationPingPeriod  = 15 * time.Second
+)
+
+func replicationPolicyFromEnv() (ReplicationPolicy, error) {
+	switch policy := ReplicationPolicy(os.Getenv("NIMBUS_IO_REPLICATION")); policy {
+	case "", ReplicationNone:
+		return ReplicationNone, nil
+	case ReplicationAsync, ReplicationQuorum:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid NIMBUS_IO_REPLICATION '%s'", policy)
+	}
+}
+
+// peer is one replication target: a pooled connection plus the health
+// and lag state the reaper-style ping loop maintains.
+type peer struct {
+	nodeName string
+	nodeID   uint32
+	address  string
+
+	mu      sync.Mutex
+	conn    *replicationConn
+	healthy bool
+	lastAck time.Time
+	lagMS   int64
+}
+
+// Replicator mirrors StoreSequence (and the segment lifecycle calls
+// around it) to the other data-writers in the cluster, so durability
+// does not have to wait for anti-entropy handoff to catch up.
+type Replicator struct {
+	Policy       ReplicationPolicy
+	selfNodeName string
+	dialTimeout  time.Duration
+	ackTimeout   time.Duration
+	tlsConfig    *tls.Config
+
+	mu    sync.RWMutex
+	peers map[string]*peer
+}
+
+// NewReplicator dials every peer in nodeIDMap other than selfNodeName
+// and starts a background health-check loop for each. A peer that
+// cannot be dialed at startup is kept in the pool as unhealthy and
+// retried by the health-check loop, rather than failing the whole
+// writer: a replication peer being briefly unreachable should not
+// block local writes.
+func NewReplicator(policy ReplicationPolicy, nodeIDMap map[string]uint32,
+	selfNodeName string) (*Replicator, error) {
+
+	dialTimeout, err := durationFromEnv("NIMBUS_IO_REPLICATION_DIAL_TIMEOUT",
+		defaultReplicationDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ackTimeout, err := durationFromEnv("NIMBUS_IO_REPLICATION_ACK_TIMEOUT",
+		defaultReplicationAckTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := replicationTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replicator{
+		Policy:       policy,
+		selfNodeName: selfNodeName,
+		dialTimeout:  dialTimeout,
+		ackTimeout:   ackTimeout,
+		tlsConfig:    tlsConfig,
+		peers:        make(map[string]*peer),
+	}
+
+	for nodeName, nodeID := range nodeIDMap {
+		if nodeName == selfNodeName {
+			continue
+		}
+
+		address, err := tools.GetNodeReplicationAddress(nodeName)
+		if err != nil {
+			return nil, fmt.Errorf("NewReplicator: %s", err)
+		}
+
+		p := &peer{nodeName: nodeName, nodeID: nodeID, address: address}
+		r.peers[nodeName] = p
+
+		go r.healthCheckLoop(p)
+	}
+
+	return r, nil
+}
+
+// replicationTLSConfig loads a client certificate for peer connections
+// if NIMBUS_IO_REPLICATION_TLS_CERT/_KEY are set; otherwise replication
+// runs over plain TCP, which is the default for a trusted cluster
+// network.
+func replicationTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("NIMBUS_IO_REPLICATION_TLS_CERT")
+	keyFile := os.Getenv("NIMBUS_IO_REPLICATION_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("replicationTLSConfig LoadX509KeyPair %s", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (r *Replicator) dial(p *peer) (*replicationConn, error) {
+	var conn net.Conn
+	var err error
+
+	if r.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: r.dialTimeout},
+			"tcp", p.address, r.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", p.address, r.dialTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial peer %s (%s) %s", p.nodeName, p.address, err)
+	}
+
+	return newReplicationConn(conn), nil
+}
+
+// healthCheckLoop keeps p.conn connected and marks p healthy/unhealthy
+// based on whether a Ping round trip succeeds, and records the
+// observed round-trip time as the peer's current lag.
+func (r *Replicator) healthCheckLoop(p *peer) {
+	ticker := time.NewTicker(defaultReplicationPingPeriod)
+	defer ticker.Stop()
+
+	r.pingPeer(p)
+	for range ticker.C {
+		r.pingPeer(p)
+	}
+}
+
+func (r *Replicator) pingPeer(p *peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		conn, err := r.dial(p)
+		if err != nil {
+			p.healthy = false
+			return
+		}
+		p.conn = conn
+	}
+
+	started := tools.Timestamp()
+	if err := p.conn.ping(); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		p.healthy = false
+		return
+	}
+
+	p.healthy = true
+	p.lastAck = tools.Timestamp()
+	p.lagMS = p.lastAck.Sub(started).Milliseconds()
+}
+
+// PeerLag reports the last observed round-trip time, in milliseconds,
+// for nodeName, for use as a replication metric.
+func (r *Replicator) PeerLag(nodeName string) (int64, bool) {
+	r.mu.RLock()
+	p, ok := r.peers[nodeName]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lagMS, p.healthy
+}
+
+// quorumSize is ceil((n+1)/2) of the cluster, counting this node: the
+// smallest number of nodes (including self) that constitutes a
+// majority.
+func quorumSize(peerCount int) int {
+	n := peerCount + 1
+	return int(math.Ceil(float64(n+1) / 2))
+}
+
+// ReplicateAppendSequence sends an AppendSequence RPC to every peer
+// concurrently (a peer with no live connection counts as a missed ack)
+// and waits, up to r.ackTimeout per peer, for acks
+// from a majority of the cluster (including this node, which already
+// has the data locally). It returns the set of peers that did not ack
+// in time, which the caller should record for anti-entropy handoff;
+// it only returns an error if quorum itself could not be reached.
+//
+// offset is the value-file offset StoreSequence just wrote data at
+// locally; it is carried in the RPC unchanged, but replicationServer
+// does not use it: a peer stores the data at its own value file's
+// current offset.
+func (r *Replicator) ReplicateAppendSequence(segment msg.Segment, sequence msg.Sequence,
+	offset uint64, data []byte) ([]string, error) {
+
+	r.mu.RLock()
+	peers := make([]*peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p)
+	}
+	r.mu.RUnlock()
+
+	payload := replAppendSequence{
+		Segment:         segment,
+		SequenceNum:     sequence.SequenceNum,
+		Offset:          offset,
+		ZfecPaddingSize: sequence.ZfecPaddingSize,
+		SegmentSize:     sequence.SegmentSize,
+		Data:            data,
+		MD5Digest:       sequence.MD5Digest,
+		Adler32:         sequence.Adler32,
+	}
+
+	type result struct {
+		nodeName string
+		err      error
+	}
+
+	results := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p *peer) {
+			results <- result{nodeName: p.nodeName, err: r.sendToPeer(p, payload)}
+		}(p)
+	}
+
+	var failed []string
+	acked := 1 // this node already has the write locally
+	needed := quorumSize(len(peers))
+
+	for i := 0; i < len(peers); i++ {
+		res := <-results
+		if res.err != nil {
+			failed = append(failed, res.nodeName)
+			continue
+		}
+		acked++
+	}
+
+	if acked < needed {
+		return failed, fmt.Errorf(
+			"ReplicateAppendSequence: only %d/%d acks, needed %d for quorum",
+			acked, len(peers)+1, needed)
+	}
+
+	return failed, nil
+}
+
+func (r *Replicator) sendToPeer(p *peer, payload replAppendSequence) error {
+	return r.callPeer(p, replMsgAppendSequence, payload)
+}
+
+// callPeer sends one RPC to p over its pooled connection, enforcing
+// r.ackTimeout. It is the common path for every Replicate* method.
+//
+// p.mu is held for the whole write-then-read round trip, not just the
+// conn lookup: p has exactly one shared net.Conn, so two calls in
+// flight at once (a concurrent StoreSequence and pingPeer's 15s health
+// check, or two concurrent StoreSequence calls once the writer stopped
+// assuming a single caller) would otherwise interleave writes on the
+// wire and could read back the ack meant for a different call. This
+// mirrors pingPeer, which already holds p.mu across its own round trip.
+func (r *Replicator) callPeer(p *peer, msgType replicationMsgType, payload interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return fmt.Errorf("peer %s has no connection", p.nodeName)
+	}
+
+	p.conn.conn.SetDeadline(tools.Timestamp().Add(r.ackTimeout))
+	defer p.conn.conn.SetDeadline(time.Time{})
+
+	_, err := p.conn.call(msgType, payload)
+	return err
+}
+
+// broadcast sends payload to every peer concurrently via msgType and
+// returns the node names that did not ack, for the caller to log; it
+// never blocks on quorum, since Prepare/Commit/Cancel are advisory
+// mirrors of segment-lifecycle state rather than durability-bearing
+// writes the way StoreSequence is. A replPrepareSegment payload is sent
+// to each peer with NodeNames.HandoffNodeName set to that peer's name.
+func (r *Replicator) broadcast(msgType replicationMsgType, payload interface{}) []string {
+	r.mu.RLock()
+	peers := make([]*peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p)
+	}
+	r.mu.RUnlock()
+
+	type result struct {
+		nodeName string
+		err      error
+	}
+
+	results := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p *peer) {
+			body := payload
+			if prepare, ok := payload.(replPrepareSegment); ok {
+				prepare.NodeNames.HandoffNodeName = p.nodeName
+				body = prepare
+			}
+			results <- result{nodeName: p.nodeName, err: r.callPeer(p, msgType, body)}
+		}(p)
+	}
+
+	var failed []string
+	for i := 0; i < len(peers); i++ {
+		if res := <-results; res.err != nil {
+			failed = append(failed, res.nodeName)
+		}
+	}
+
+	return failed
+}
+
+// ReplicatePrepareSegment mirrors StartSegment to every peer, with
+// NodeNames.HandoffNodeName set to the peer's own node name so each
+// peer applies it through the existing -for-handoff SQL paths. It is
+// best-effort: a peer that misses it will pick the segment up later
+// through anti-entropy handoff, so failures are only logged by the
+// caller, not treated as a StartSegment failure.
+func (r *Replicator) ReplicatePrepareSegment(segment msg.Segment, nodeNames msg.NodeNames) []string {
+	return r.broadcast(replMsgPrepareSegment, replPrepareSegment{
+		Segment:   segment,
+		NodeNames: nodeNames,
+	})
+}
+
+// ReplicateCommitSegment mirrors FinishSegment to every peer.
+func (r *Replicator) ReplicateCommitSegment(segment msg.Segment, file msg.File) []string {
+	return r.broadcast(replMsgCommitSegment, replCommitSegment{
+		Segment:   segment,
+		FileSize:  file.FileSize,
+		MD5Digest: file.MD5Digest,
+		Adler32:   file.Adler32,
+	})
+}
+
+// ReplicateCancelSegment mirrors CancelSegment to every peer.
+func (r *Replicator) ReplicateCancelSegment(cancel msg.Cancel) []string {
+	return r.broadcast(replMsgCancelSegment, replCancelSegment{Cancel: cancel})
+}
+
+// Close shuts down every peer connection.
+func (r *Replicator) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, p := range r.peers {
+		p.mu.Lock()
+		if p.conn != nil {
+			p.conn.Close()
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}
+
+	return nil
+}
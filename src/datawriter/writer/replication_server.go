@@ -0,0 +1,204 @@
+package writer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"datawriter/logger"
+	"datawriter/msg"
+)
+
+// replicationServer is the receiving side of the Replicator protocol:
+// it listens for connections from peer data-writers and applies each
+// incoming RPC against the local NimbusioWriter's log*/apply* methods,
+// giving it the same durable WAL record and Store/SegmentMap/ValueFile
+// state a client-originated write would, without re-broadcasting
+// through this node's own Replicator.
+type replicationServer struct {
+	listener net.Listener
+	writer   *nimbusioWriter
+	lgr      logger.Logger
+}
+
+// StartReplicationServer listens on address (TLS, if tlsConfig is
+// non-nil) and returns once listening; a goroutine of its own serves
+// incoming replication RPCs until the listener is closed.
+// NewNimbusioWriter calls it once whenever replication is enabled.
+func (writer *nimbusioWriter) StartReplicationServer(lgr logger.Logger,
+	address string, tlsConfig *tls.Config) (*replicationServer, error) {
+
+	var listener net.Listener
+	var err error
+
+	if tlsConfig != nil {
+		listener, err = tls.Listen("tcp", address, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("StartReplicationServer Listen %s %s", address, err)
+	}
+
+	server := &replicationServer{listener: listener, writer: writer, lgr: lgr}
+	go server.acceptLoop()
+
+	return server, nil
+}
+
+func (server *replicationServer) acceptLoop() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			// Accept returns an error once the listener has been
+			// closed by Close; the loop ends on any Accept error.
+			return
+		}
+
+		go server.serve(conn)
+	}
+}
+
+func (server *replicationServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rc := newReplicationConn(conn)
+
+	for {
+		envelope, err := readReplFrame(rc.reader)
+		if err != nil {
+			return
+		}
+
+		ack := server.apply(envelope)
+
+		body, err := replEncodeBody(ack)
+		if err != nil {
+			server.lgr.Error("replicationServer.serve: encode ack %s", err)
+			return
+		}
+
+		if err := writeReplFrame(conn, replMsgAck, body); err != nil {
+			return
+		}
+	}
+}
+
+// apply dispatches one decoded RPC envelope against the local
+// NimbusioWriter and turns the result into a replAck.
+//
+// It logs and applies through writer's unexported log*/apply* methods
+// directly instead of calling the public StartSegment/StoreSequence/
+// FinishSegment/CancelSegment methods. Those public methods
+// unconditionally re-broadcast to writer.Replicator when it is
+// non-nil, which it is on every node of a real cluster; calling them
+// here would make an incoming replicated write cascade back out to
+// this node's own peers (including the one it just came from), each of
+// which would do the same. log*+apply* gives this node the same
+// durable local WAL record and Store/SegmentMap/ValueFile state a
+// client-originated write would, without re-entering the Replicator.
+func (server *replicationServer) apply(envelope replEnvelope) replAck {
+	var err error
+
+	switch envelope.Type {
+	case replMsgPing:
+		// no-op: a successful round trip is the health check itself.
+
+	case replMsgPrepareSegment:
+		var req replPrepareSegment
+		if err = replDecodeBody(envelope.Body, &req); err == nil {
+			err = server.applyStartSegment(req.Segment, req.NodeNames)
+		}
+
+	case replMsgAppendSequence:
+		var req replAppendSequence
+		if err = replDecodeBody(envelope.Body, &req); err == nil {
+			sequence := msg.Sequence{
+				SequenceNum:     req.SequenceNum,
+				ZfecPaddingSize: req.ZfecPaddingSize,
+				SegmentSize:     req.SegmentSize,
+				MD5Digest:       req.MD5Digest,
+				Adler32:         req.Adler32,
+			}
+			err = server.applyStoreSequence(req.Segment, sequence, req.Data)
+		}
+
+	case replMsgCommitSegment:
+		var req replCommitSegment
+		if err = replDecodeBody(envelope.Body, &req); err == nil {
+			file := msg.File{
+				FileSize:  req.FileSize,
+				MD5Digest: req.MD5Digest,
+				Adler32:   req.Adler32,
+			}
+			err = server.applyFinishSegment(req.Segment, file)
+		}
+
+	case replMsgCancelSegment:
+		var req replCancelSegment
+		if err = replDecodeBody(envelope.Body, &req); err == nil {
+			err = server.applyCancelSegment(req.Cancel)
+		}
+
+	default:
+		err = fmt.Errorf("replicationServer.apply: unknown message type %d", envelope.Type)
+	}
+
+	if err != nil {
+		return replAck{OK: false, Error: err.Error()}
+	}
+
+	return replAck{OK: true}
+}
+
+func (server *replicationServer) applyStartSegment(segment msg.Segment,
+	nodeNames msg.NodeNames) error {
+
+	server.lgr.Debug("replicationServer.apply: StartSegment")
+
+	if err := server.writer.logStartSegment(segment, nodeNames); err != nil {
+		return fmt.Errorf("logStartSegment %s", err)
+	}
+
+	return server.writer.applyStartSegment(segment, nodeNames)
+}
+
+func (server *replicationServer) applyStoreSequence(segment msg.Segment,
+	sequence msg.Sequence, data []byte) error {
+
+	server.lgr.Debug("replicationServer.apply: StoreSequence #%d", sequence.SequenceNum)
+
+	if err := server.writer.logStoreSequence(segment, sequence, data); err != nil {
+		return fmt.Errorf("logStoreSequence %s", err)
+	}
+
+	_, _, err := server.writer.applyStoreSequence(server.lgr, segment, sequence, data)
+	return err
+}
+
+func (server *replicationServer) applyFinishSegment(segment msg.Segment,
+	file msg.File) error {
+
+	server.lgr.Debug("replicationServer.apply: FinishSegment")
+
+	if err := server.writer.logFinishSegment(segment, file); err != nil {
+		return fmt.Errorf("logFinishSegment %s", err)
+	}
+
+	return server.writer.applyFinishSegment(segment, file)
+}
+
+func (server *replicationServer) applyCancelSegment(cancel msg.Cancel) error {
+	server.lgr.Debug("replicationServer.apply: CancelSegment")
+
+	if err := server.writer.logCancelSegment(cancel); err != nil {
+		return fmt.Errorf("logCancelSegment %s", err)
+	}
+
+	return server.writer.applyCancelSegment(cancel)
+}
+
+// Close stops accepting new replication connections.
+func (server *replicationServer) Close() error {
+	return server.listener.Close()
+}
@@ -0,0 +1,54 @@
+package writer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestQuorumSize(t *testing.T) {
+	testCases := []struct {
+		peerCount int
+		expected  int
+	}{
+		{peerCount: 0, expected: 1},
+		{peerCount: 1, expected: 2},
+		{peerCount: 2, expected: 2},
+		{peerCount: 3, expected: 3},
+		{peerCount: 4, expected: 3},
+	}
+
+	for _, testCase := range testCases {
+		if got := quorumSize(testCase.peerCount); got != testCase.expected {
+			t.Errorf("quorumSize(%d) = %d, want %d", testCase.peerCount, got,
+				testCase.expected)
+		}
+	}
+}
+
+func TestReplFrameRoundTrip(t *testing.T) {
+	body, err := replEncodeBody(replAck{OK: true, PeerNodeID: 42})
+	if err != nil {
+		t.Fatalf("replEncodeBody() error = %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeReplFrame(&buf, replMsgAck, body); err != nil {
+		t.Fatalf("writeReplFrame() error = %s", err)
+	}
+
+	envelope, err := readReplFrame(&buf)
+	if err != nil {
+		t.Fatalf("readReplFrame() error = %s", err)
+	}
+	if envelope.Type != replMsgAck {
+		t.Fatalf("envelope.Type = %d, want %d", envelope.Type, replMsgAck)
+	}
+
+	var ack replAck
+	if err := replDecodeBody(envelope.Body, &ack); err != nil {
+		t.Fatalf("replDecodeBody() error = %s", err)
+	}
+	if !ack.OK || ack.PeerNodeID != 42 {
+		t.Errorf("got ack %+v, want {OK:true PeerNodeID:42}", ack)
+	}
+}
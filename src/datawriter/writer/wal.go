@@ -0,0 +1,299 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// record types for the write-ahead log. Each value identifies the shape
+// of the payload that follows a record header.
+const (
+	walRecordStartSegment byte = iota + 1
+	walRecordStoreSequence
+	walRecordFinishSegment
+	walRecordCancelSegment
+	walRecordDestroyKey
+	walRecordStartConjoined
+	walRecordAbortConjoined
+	walRecordFinishConjoined
+	walRecordCheckpoint
+)
+
+// defaultWALSegmentSize is used when NIMBUS_IO_WAL_SEGMENT_SIZE is unset.
+const defaultWALSegmentSize = uint64(64 * 1024 * 1024)
+
+// wal is an append-only, segmented, crc-checked log of mutating writer
+// operations. Every record is durable on disk before the corresponding
+// Postgres row or value-file byte is written, so a crash between those
+// two steps can be detected and replayed on restart.
+//
+// record layout: 1 byte type | 4 byte little-endian length | 4 byte
+// crc32c of the payload | payload.
+type wal struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize uint64
+	segmentNum  uint64
+	file        *os.File
+	fileSize    uint64
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newWAL opens (creating if necessary) the WAL directory under repoPath
+// and appends to the latest segment, creating segment 0 if the
+// directory is empty.
+func newWAL(repoPath string) (*wal, error) {
+	dir := filepath.Join(repoPath, "wal")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("newWAL MkdirAll %s %s", dir, err)
+	}
+
+	segmentSize := defaultWALSegmentSize
+	if sizeStr := os.Getenv("NIMBUS_IO_WAL_SEGMENT_SIZE"); sizeStr != "" {
+		size, err := strconv.ParseUint(sizeStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NIMBUS_IO_WAL_SEGMENT_SIZE '%s'", sizeStr)
+		}
+		segmentSize = size
+	}
+
+	segments, err := walSegmentNumbers(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{dir: dir, segmentSize: segmentSize}
+
+	if len(segments) == 0 {
+		if err := w.createSegment(0); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	latest := segments[len(segments)-1]
+	if err := w.openSegment(latest); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func walSegmentPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.wal", num))
+}
+
+// walSegmentNumbers returns the segment numbers present in dir, sorted
+// ascending.
+func walSegmentNumbers(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("walSegmentNumbers ReadDir %s", err)
+	}
+
+	var nums []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	return nums, nil
+}
+
+func (w *wal) createSegment(num uint64) error {
+	file, err := os.OpenFile(walSegmentPath(w.dir, num),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("wal createSegment %s", err)
+	}
+
+	w.file = file
+	w.segmentNum = num
+	w.fileSize = 0
+
+	return nil
+}
+
+func (w *wal) openSegment(num uint64) error {
+	file, err := os.OpenFile(walSegmentPath(w.dir, num),
+		os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("wal openSegment %s", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("wal openSegment Stat %s", err)
+	}
+
+	w.file = file
+	w.segmentNum = num
+	w.fileSize = uint64(info.Size())
+
+	return nil
+}
+
+// Log appends a single record to the current segment, rotating to a new
+// segment first if the configured segment size would be exceeded. The
+// record is fsync'd before Log returns so the caller can rely on it
+// surviving a crash.
+func (w *wal) Log(recordType byte, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recordSize := uint64(1 + 4 + 4 + len(payload))
+	if w.fileSize > 0 && w.fileSize+recordSize > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 9)
+	header[0] = recordType
+	binary.LittleEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[5:9], crc32.Checksum(payload, crc32cTable))
+
+	if _, err := w.file.Write(header); err != nil {
+		return fmt.Errorf("wal Log write header %s", err)
+	}
+	if _, err := w.file.Write(payload); err != nil {
+		return fmt.Errorf("wal Log write payload %s", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("wal Log sync %s", err)
+	}
+
+	w.fileSize += recordSize
+
+	return nil
+}
+
+// rotate closes the current segment and begins a new one. Callers must
+// hold w.mu.
+func (w *wal) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("wal rotate close %s", err)
+	}
+
+	return w.createSegment(w.segmentNum + 1)
+}
+
+// Checkpoint records that every operation durable in the WAL up to this
+// point has been fully applied (the value file is closed and its
+// update-value-file row committed), then removes segments older than
+// the current one since they can no longer contribute to a replay.
+func (w *wal) Checkpoint() error {
+	if err := w.Log(walRecordCheckpoint, nil); err != nil {
+		return fmt.Errorf("wal Checkpoint %s", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments, err := walSegmentNumbers(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, num := range segments {
+		if num >= w.segmentNum {
+			continue
+		}
+		if err := os.Remove(walSegmentPath(w.dir, num)); err != nil {
+			return fmt.Errorf("wal Checkpoint remove segment %d %s", num, err)
+		}
+	}
+
+	return nil
+}
+
+// walRecord is a decoded, not-yet-applied entry handed to the replay
+// callback.
+type walRecord struct {
+	Type    byte
+	Payload []byte
+}
+
+// replayWAL reads every record across all segments in dir, in order,
+// and invokes apply for each one. A torn tail record (one left
+// incomplete by a crash mid-write) is detected by a short read or a
+// CRC mismatch; replayWAL stops cleanly at that point instead of
+// returning an error, since everything after it was never durable.
+func replayWAL(dir string, apply func(walRecord) error) error {
+	segments, err := walSegmentNumbers(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, num := range segments {
+		if err := replayWALSegment(walSegmentPath(dir, num), apply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replayWALSegment(path string, apply func(walRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("replayWALSegment Open %s", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		header := make([]byte, 9)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("replayWALSegment read header %s", err)
+		}
+
+		recordType := header[0]
+		length := binary.LittleEndian.Uint32(header[1:5])
+		wantCRC := binary.LittleEndian.Uint32(header[5:9])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// torn tail record: the length header was written but the
+				// payload was not fully flushed before the crash.
+				return nil
+			}
+			return fmt.Errorf("replayWALSegment read payload %s", err)
+		}
+
+		if crc32.Checksum(payload, crc32cTable) != wantCRC {
+			// torn tail record at EOF, or corruption; either way we stop
+			// replaying rather than risk applying garbage.
+			return nil
+		}
+
+		if err := apply(walRecord{Type: recordType, Payload: payload}); err != nil {
+			return err
+		}
+	}
+}
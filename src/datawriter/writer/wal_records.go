@@ -0,0 +1,337 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+
+	"tools"
+
+	"datawriter/msg"
+	"datawriter/types"
+)
+
+// These mirror the arguments of the NimbusioWriter methods they
+// precede. They are gob-encoded as the WAL record payload so that
+// replay can reconstruct the call without depending on the wire
+// message formats, which may evolve independently of the log.
+
+type walStartSegment struct {
+	Segment   msg.Segment
+	NodeNames msg.NodeNames
+}
+
+type walStoreSequence struct {
+	Segment  msg.Segment
+	Sequence msg.Sequence
+	Data     []byte
+}
+
+type walFinishSegment struct {
+	Segment msg.Segment
+	File    msg.File
+}
+
+type walCancelSegment struct {
+	Cancel msg.Cancel
+}
+
+type walDestroyKey struct {
+	Segment            msg.Segment
+	UnifiedIDToDestroy uint64
+}
+
+type walConjoined struct {
+	ConjoinedEntry types.ConjoinedEntry
+}
+
+func walEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, fmt.Errorf("walEncode %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func walDecode(payload []byte, v interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v); err != nil {
+		return fmt.Errorf("walDecode %s", err)
+	}
+	return nil
+}
+
+// logStartSegment durably records a StartSegment call before any
+// Postgres or value-file state changes.
+func (writer *nimbusioWriter) logStartSegment(segment msg.Segment,
+	nodeNames msg.NodeNames) error {
+	payload, err := walEncode(walStartSegment{Segment: segment, NodeNames: nodeNames})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(walRecordStartSegment, payload)
+}
+
+// logStoreSequence durably records a StoreSequence call before the
+// new-segment-sequence row or value-file bytes are written.
+func (writer *nimbusioWriter) logStoreSequence(segment msg.Segment,
+	sequence msg.Sequence, data []byte) error {
+	payload, err := walEncode(walStoreSequence{Segment: segment, Sequence: sequence, Data: data})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(walRecordStoreSequence, payload)
+}
+
+// logFinishSegment durably records a FinishSegment call.
+func (writer *nimbusioWriter) logFinishSegment(segment msg.Segment,
+	file msg.File) error {
+	payload, err := walEncode(walFinishSegment{Segment: segment, File: file})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(walRecordFinishSegment, payload)
+}
+
+// logCancelSegment durably records a CancelSegment call.
+func (writer *nimbusioWriter) logCancelSegment(cancel msg.Cancel) error {
+	payload, err := walEncode(walCancelSegment{Cancel: cancel})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(walRecordCancelSegment, payload)
+}
+
+// logDestroyKey durably records a DestroyKey call.
+func (writer *nimbusioWriter) logDestroyKey(segment msg.Segment,
+	unifiedIDToDestroy uint64) error {
+	payload, err := walEncode(walDestroyKey{Segment: segment, UnifiedIDToDestroy: unifiedIDToDestroy})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(walRecordDestroyKey, payload)
+}
+
+// logConjoined durably records a Start/Abort/FinishConjoinedArchive
+// call under the record type matching which of the three it is.
+func (writer *nimbusioWriter) logConjoined(recordType byte,
+	conjoinedEntry types.ConjoinedEntry) error {
+	payload, err := walEncode(walConjoined{ConjoinedEntry: conjoinedEntry})
+	if err != nil {
+		return err
+	}
+	return writer.WAL.Log(recordType, payload)
+}
+
+// startupLogger satisfies logger.Logger for the one-time WAL replay
+// that happens before NewNimbusioWriter has any request to attach a
+// real per-connection logger to.
+type startupLogger struct{}
+
+func (startupLogger) Debug(format string, args ...interface{}) {
+	log.Printf("DEBUG "+format, args...)
+}
+func (startupLogger) Info(format string, args ...interface{}) {
+	log.Printf("INFO "+format, args...)
+}
+func (startupLogger) Warn(format string, args ...interface{}) {
+	log.Printf("WARN "+format, args...)
+}
+func (startupLogger) Error(format string, args ...interface{}) {
+	log.Printf("ERROR "+format, args...)
+}
+
+// replayWALRecords re-applies every operation found in the WAL that
+// was durably logged but whose corresponding segment_sequence (or
+// equivalent) row was never committed, because the process crashed
+// between the WAL write and the database write. Each apply path below
+// first checks whether the row already exists and skips the operation
+// if so, making replay idempotent against partially-completed runs.
+//
+// Replay calls the unexported apply* methods directly rather than the
+// public StartSegment/StoreSequence/... methods: the public methods
+// log a fresh WAL record on the way in, which would append to the same
+// segment file replayWAL is still reading and grow the WAL on every
+// restart, and they would re-broadcast to replication peers that
+// already have the record. apply* only touches Store/SegmentMap/
+// ValueFile, so replay is a state catch-up with no side effects on the
+// Replicator; its only effect on the WAL is the Checkpoint record
+// applyStoreSequence logs when it rotates to a new value file.
+func (writer *nimbusioWriter) replayWALRecords() error {
+	lgr := startupLogger{}
+	return replayWAL(writer.WAL.dir, func(record walRecord) error {
+		switch record.Type {
+		case walRecordCheckpoint:
+			return nil
+
+		case walRecordStartSegment:
+			var r walStartSegment
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			exists, err := writer.Store.SegmentExists(r.Segment)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: SegmentExists %s", err)
+			}
+			if exists {
+				// The Store row was already committed before the crash;
+				// StartSegment itself won't run again, so SegmentMap has
+				// to be repopulated here or later replay steps for the
+				// same segment (StoreSequence, FinishSegment) will fail
+				// with "unknown segment".
+				return writer.restoreSegmentMapEntry(r.Segment)
+			}
+			lgr.Warn("WAL replay: re-applying StartSegment %s", segmentKeyOf(r.Segment))
+			return writer.applyStartSegment(r.Segment, r.NodeNames)
+
+		case walRecordStoreSequence:
+			var r walStoreSequence
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			exists, err := writer.Store.SequenceExists(r.Segment, r.Sequence)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: SequenceExists %s", err)
+			}
+			if exists {
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying StoreSequence %s #%d",
+				segmentKeyOf(r.Segment), r.Sequence.SequenceNum)
+			_, _, applyErr := writer.applyStoreSequence(lgr, r.Segment, r.Sequence, r.Data)
+			return applyErr
+
+		case walRecordFinishSegment:
+			var r walFinishSegment
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			exists, err := writer.Store.SegmentExists(r.Segment)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: SegmentExists %s", err)
+			}
+			if !exists {
+				return nil
+			}
+			key := segmentKeyOf(r.Segment)
+			writer.mu.RLock()
+			_, inMap := writer.SegmentMap[key]
+			writer.mu.RUnlock()
+			if !inMap {
+				// FinishSegment already ran (it removes the segment from
+				// SegmentMap on success) and there's nothing left to redo.
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying FinishSegment %s", key)
+			return writer.applyFinishSegment(r.Segment, r.File)
+
+		case walRecordCancelSegment:
+			var r walCancelSegment
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			key := segmentKey{r.Cancel.UnifiedID, r.Cancel.ConjoinedPart, r.Cancel.SegmentNum}
+			cancelled, err := writer.Store.SegmentCancelled(msg.Segment{UnifiedID: key.UnifiedID,
+				ConjoinedPart: key.ConjoinedPart, SegmentNum: key.SegmentNum})
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: SegmentCancelled %s", err)
+			}
+			if cancelled {
+				// The cancel committed before the crash, but replaying this
+				// segment's StartSegment record put it back in SegmentMap.
+				writer.mu.Lock()
+				delete(writer.SegmentMap, key)
+				writer.mu.Unlock()
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying CancelSegment %s", key)
+			return writer.applyCancelSegment(r.Cancel)
+
+		case walRecordDestroyKey:
+			var r walDestroyKey
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			exists, err := writer.Store.TombstoneExists(r.Segment, r.UnifiedIDToDestroy)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: TombstoneExists %s", err)
+			}
+			if exists {
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying DestroyKey (%d)", r.UnifiedIDToDestroy)
+			return writer.applyDestroyKey(r.Segment, r.UnifiedIDToDestroy)
+
+		case walRecordStartConjoined:
+			var r walConjoined
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			exists, err := writer.Store.ConjoinedExists(r.ConjoinedEntry)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: ConjoinedExists %s", err)
+			}
+			if exists {
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying StartConjoinedArchive %s", r.ConjoinedEntry)
+			return writer.applyStartConjoined(r.ConjoinedEntry)
+
+		case walRecordAbortConjoined:
+			var r walConjoined
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			aborted, err := writer.Store.ConjoinedAborted(r.ConjoinedEntry)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: ConjoinedAborted %s", err)
+			}
+			if aborted {
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying AbortConjoinedArchive %s", r.ConjoinedEntry)
+			return writer.applyAbortConjoined(r.ConjoinedEntry)
+
+		case walRecordFinishConjoined:
+			var r walConjoined
+			if err := walDecode(record.Payload, &r); err != nil {
+				return err
+			}
+			finished, err := writer.Store.ConjoinedFinished(r.ConjoinedEntry)
+			if err != nil {
+				return fmt.Errorf("replayWALRecords: ConjoinedFinished %s", err)
+			}
+			if finished {
+				return nil
+			}
+			lgr.Warn("WAL replay: re-applying FinishConjoinedArchive %s", r.ConjoinedEntry)
+			return writer.applyFinishConjoined(r.ConjoinedEntry)
+		}
+
+		return fmt.Errorf("replayWALRecords: unknown record type %d", record.Type)
+	})
+}
+
+func segmentKeyOf(segment msg.Segment) segmentKey {
+	return segmentKey{segment.UnifiedID, segment.ConjoinedPart, segment.SegmentNum}
+}
+
+// restoreSegmentMapEntry repopulates SegmentMap for a segment whose
+// StartSegment WAL record is being skipped during replay because the
+// Store row was already committed before the crash.
+func (writer *nimbusioWriter) restoreSegmentMapEntry(segment msg.Segment) error {
+	segmentID, sourceNodeID, err := writer.Store.LookupSegment(segment)
+	if err != nil {
+		return fmt.Errorf("restoreSegmentMapEntry: LookupSegment %s", err)
+	}
+
+	writer.mu.Lock()
+	writer.SegmentMap[segmentKeyOf(segment)] = segmentMapEntry{
+		SegmentID:      segmentID,
+		SourceNodeID:   sourceNodeID,
+		LastActionTime: tools.Timestamp(),
+	}
+	writer.mu.Unlock()
+
+	return nil
+}
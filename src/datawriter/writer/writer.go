@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"tools"
@@ -63,16 +64,32 @@ func (key segmentKey) String() string {
 
 type segmentMapEntry struct {
 	SegmentID      uint64
+	SourceNodeID   uint32
 	LastActionTime time.Time
 }
 
 // map data contained in messages onto our internal segment id
 type nimbusioWriter struct {
+	mu sync.RWMutex // guards SegmentMap
+
+	// valueFileMu guards ValueFile: its Size()/Store() pair in
+	// applyStoreSequence must run as one critical section (the offset
+	// read and the append it's paired with can't be interleaved with
+	// another goroutine's), and Close()/replacement on rotation must not
+	// race a concurrent Size()/Store(). Locally-originated StoreSequence
+	// calls and replicationServer.apply both reach applyStoreSequence, so
+	// this can no longer assume a single caller.
+	valueFileMu sync.Mutex
+
 	NodeIDMap        map[string]uint32
 	SegmentMap       map[segmentKey]segmentMapEntry
 	FileSpaceInfo    tools.FileSpaceInfo
 	ValueFile        OutputValueFile
 	MaxValueFileSize uint64
+	WAL              *wal
+	Store            MetadataStore
+	Replicator       *Replicator
+	ReplicationSrv   *replicationServer
 }
 
 // NewNimbusioWriter returns an entity that implements the NimbusioWriter interface
@@ -98,7 +115,27 @@ func NewNimbusioWriter() (NimbusioWriter, error) {
 		writer.MaxValueFileSize = uint64(intSize)
 	}
 
-	if writer.FileSpaceInfo, err = tools.NewFileSpaceInfo(nodedb.NodeDB); err != nil {
+	repoPath := os.Getenv("NIMBUSIO_REPOSITORY_PATH")
+	if repoPath == "" {
+		return nil, fmt.Errorf("NIMBUSIO_REPOSITORY_PATH is not set")
+	}
+
+	metadataBackend := os.Getenv("NIMBUS_IO_METADATA_BACKEND")
+	if writer.Store, err = newMetadataStore(metadataBackend, repoPath); err != nil {
+		return nil, fmt.Errorf("newMetadataStore %s", err)
+	}
+
+	// FileSpaceInfo's source depends on the same backend choice: the
+	// Postgres-backed space_usage tables for a clustered deployment, or
+	// a single directory under repoPath for a leveldb-only node that
+	// has no Postgres to query.
+	switch metadataBackend {
+	case "", "postgres":
+		writer.FileSpaceInfo, err = tools.NewFileSpaceInfo(nodedb.NodeDB)
+	case "leveldb":
+		writer.FileSpaceInfo, err = tools.NewLocalFileSpaceInfo(repoPath)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -106,115 +143,318 @@ func NewNimbusioWriter() (NimbusioWriter, error) {
 		return nil, err
 	}
 
+	if writer.WAL, err = newWAL(repoPath); err != nil {
+		return nil, fmt.Errorf("newWAL %s", err)
+	}
+
+	if err = writer.replayWALRecords(); err != nil {
+		return nil, fmt.Errorf("replayWALRecords %s", err)
+	}
+
+	if eventBusAddress := os.Getenv("NIMBUS_IO_EVENT_BUS_ADDRESS"); eventBusAddress != "" {
+		go func() {
+			startupLgr := startupLogger{}
+			if err := writer.RunCascadeCancelSub(startupLgr, eventBusAddress, nil); err != nil {
+				startupLgr.Error("RunCascadeCancelSub exited: %s", err)
+			}
+		}()
+	}
+
+	checkInterval, err := durationFromEnv("NIMBUS_IO_SEGMENT_IDLE_CHECK_INTERVAL",
+		defaultSegmentIdleCheckInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout, err := durationFromEnv("NIMBUS_IO_SEGMENT_IDLE_TIMEOUT",
+		defaultSegmentIdleTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	go writer.RunIdleSegmentReaper(startupLogger{}, checkInterval, idleTimeout, nil)
+
+	replicationPolicy, err := replicationPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if replicationPolicy != ReplicationNone {
+		selfNodeName := os.Getenv("NIMBUS_IO_NODE_NAME")
+		if selfNodeName == "" {
+			return nil, fmt.Errorf("NIMBUS_IO_NODE_NAME is not set")
+		}
+
+		if writer.Replicator, err = NewReplicator(replicationPolicy, writer.NodeIDMap,
+			selfNodeName); err != nil {
+			return nil, fmt.Errorf("NewReplicator %s", err)
+		}
+
+		replicationAddress := os.Getenv("NIMBUS_IO_REPLICATION_ADDRESS")
+		if replicationAddress == "" {
+			return nil, fmt.Errorf("NIMBUS_IO_REPLICATION_ADDRESS is not set")
+		}
+
+		tlsConfig, err := replicationTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if writer.ReplicationSrv, err = writer.StartReplicationServer(startupLogger{},
+			replicationAddress, tlsConfig); err != nil {
+			return nil, fmt.Errorf("StartReplicationServer %s", err)
+		}
+	}
+
 	return &writer, nil
 }
 
-func (writer *nimbusioWriter) StartSegment(lgr logger.Logger,
-	segment msg.Segment, nodeNames msg.NodeNames) error {
+// applyStartSegment performs the state mutation StartSegment needs:
+// resolving node names to ids and recording the new segment, with no
+// WAL logging or replication of its own, so that WAL replay and
+// replicationServer.apply can drive it directly without re-triggering
+// either.
+func (writer *nimbusioWriter) applyStartSegment(segment msg.Segment,
+	nodeNames msg.NodeNames) error {
 
 	var entry segmentMapEntry
 	var err error
-	var sourceNodeID uint32
+	var sourceNodeID, handoffNodeID uint32
 	var ok bool
 
-	lgr.Debug("StartSegment")
-
-	if sourceNodeID, ok = writer.NodeIDMap[nodenames.SourceNodeName]; !ok {
-		return fmt.Errorf("unknown source node %s", nodenames.SourceNodeName)
+	if sourceNodeID, ok = writer.NodeIDMap[nodeNames.SourceNodeName]; !ok {
+		return fmt.Errorf("unknown source node %s", nodeNames.SourceNodeName)
 	}
 
 	if nodeNames.HandoffNodeName != "" {
-		if handoffNodeID, ok = writer.NodeIDMap[nodenames.HandoffNodeName]; !ok {
-			return fmt.Errorf("unknown handoff node %s", nodenames.HandoffNodeName)
+		if handoffNodeID, ok = writer.NodeIDMap[nodeNames.HandoffNodeName]; !ok {
+			return fmt.Errorf("unknown handoff node %s", nodeNames.HandoffNodeName)
 		}
+	}
 
-		stmt := nodedb.Stmts["new-segment-for-handoff"]
-		row := stmt.QueryRow(
-			segment.CollectionID,
-			segment.Key,
-			segment.UnifiedID,
-			entry.Timestamp,
-			entry.SegmentNum,
-			entry.ConjoinedPart,
-			sourceNodeID,
-			handoffNodeID)
-		err = row.Scan(&segmentID)
-	} else {
-		stmt := nodedb.Stmts["new-segment"]
-		row := stmt.QueryRow(
-			entry.CollectionID,
-			entry.Key,
-			entry.UnifiedID,
-			entry.Timestamp,
-			entry.SegmentNum,
-			entry.ConjoinedPart,
-			sourceNodeID)
-		err = row.Scan(&segmentID)
-	}
-	if entry.SegmentID, err = NewSegment(segment); err != nil {
-		return err
+	if entry.SegmentID, err = writer.Store.NewSegment(segment, sourceNodeID,
+		handoffNodeID); err != nil {
+		return fmt.Errorf("NewSegment %s", err)
 	}
+	entry.SourceNodeID = sourceNodeID
 	entry.LastActionTime = tools.Timestamp()
 
 	key := segmentKey{segment.UnifiedID, segment.ConjoinedPart,
 		segment.SegmentNum}
 
+	writer.mu.Lock()
 	writer.SegmentMap[key] = entry
+	writer.mu.Unlock()
 
 	return nil
 }
 
-func (writer *nimbusioWriter) StoreSequence(lgr logger.Logger,
-	segment msg.Segment,
-	sequence msg.Sequence, data []byte) error {
+func (writer *nimbusioWriter) StartSegment(lgr logger.Logger,
+	segment msg.Segment, nodeNames msg.NodeNames) error {
+
+	lgr.Debug("StartSegment")
+
+	if err := writer.logStartSegment(segment, nodeNames); err != nil {
+		return fmt.Errorf("logStartSegment %s", err)
+	}
+
+	if err := writer.applyStartSegment(segment, nodeNames); err != nil {
+		return err
+	}
+
+	if writer.Replicator != nil {
+		for _, peerName := range writer.Replicator.ReplicatePrepareSegment(segment, nodeNames) {
+			lgr.Info("peer %s missed PrepareSegment, will rely on handoff", peerName)
+		}
+	}
+
+	return nil
+}
+
+// applyStoreSequence performs the state mutation StoreSequence needs
+// (value-file rotation, the segment-sequence row, and the value-file
+// bytes themselves), with no WAL logging or replication of its own, so
+// that WAL replay and replicationServer.apply can drive it directly
+// without re-triggering either. It returns the value-file offset the
+// data was stored at, which the public StoreSequence needs to pass
+// along to ReplicateAppendSequence, and whether sequence had already
+// been applied.
+//
+// The already-applied check guards against a client retrying
+// StoreSequence after a quorum-replication error: without it, a retry
+// of an already-durable sequence would append the same data a second
+// time. It is only accurate because ValueFile.Store runs before
+// Store.NewSegmentSequence below, so the segment-sequence row
+// SequenceExists looks for cannot exist unless the bytes it points at
+// are already on disk.
+func (writer *nimbusioWriter) applyStoreSequence(lgr logger.Logger,
+	segment msg.Segment, sequence msg.Sequence, data []byte) (uint64, bool, error) {
 	var err error
 
-	lgr.Debug("StoreSequence #%d", sequence.SequenceNum)
+	exists, err := writer.Store.SequenceExists(segment, sequence)
+	if err != nil {
+		return 0, false, fmt.Errorf("SequenceExists %s", err)
+	}
+	if exists {
+		return 0, true, nil
+	}
+
+	key := segmentKey{segment.UnifiedID, segment.ConjoinedPart,
+		segment.SegmentNum}
+	writer.mu.RLock()
+	entry, ok := writer.SegmentMap[key]
+	writer.mu.RUnlock()
+	if !ok {
+		return 0, false, fmt.Errorf("StoreSequence unknown segment %s", key)
+	}
+
+	// valueFileMu serializes the rotation check, the offset read and the
+	// append for this sequence into one critical section: with
+	// replicationServer.apply now able to call applyStoreSequence
+	// concurrently with a locally-originated StoreSequence, two
+	// goroutines reading Size() before either calls Store() would record
+	// the same offset for two different sequences.
+	writer.valueFileMu.Lock()
+	defer writer.valueFileMu.Unlock()
 
 	if writer.ValueFile.Size()+sequence.SegmentSize >= writer.MaxValueFileSize {
 		lgr.Info("value file full")
 		if err = writer.ValueFile.Close(); err != nil {
-			return fmt.Errorf("error closing value file %s", err)
+			return 0, false, fmt.Errorf("error closing value file %s", err)
+		}
+		if err = writer.WAL.Checkpoint(); err != nil {
+			return 0, false, fmt.Errorf("error checkpointing WAL %s", err)
 		}
 		if writer.ValueFile, err = NewOutputValueFile(writer.FileSpaceInfo); err != nil {
-			return fmt.Errorf("error opening value file %s", err)
+			return 0, false, fmt.Errorf("error opening value file %s", err)
 		}
 	}
 
-	key := segmentKey{segment.UnifiedID, segment.ConjoinedPart,
-		segment.SegmentNum}
-	entry, ok := writer.SegmentMap[key]
-	if !ok {
-		return fmt.Errorf("StoreSequence unknown segment %s", key)
-	}
-
-	// we need to store new-segment-sequence in the database before
-	// ValueFile.Store, because we are using  writer.ValueFile.Size()
-	// as the offset
-
-	stmt := nodedb.Stmts["new-segment-sequence"]
-	_, err = stmt.Exec(
-		segment.CollectionID,
-		entry.SegmentID,
-		sequence.ZfecPaddingSize,
-		writer.ValueFile.ID(),
-		sequence.SequenceNum,
-		writer.ValueFile.Size(),
-		sequence.SegmentSize,
-		sequence.MD5Digest,
-		sequence.Adler32)
-	if err != nil {
-		return fmt.Errorf("new-segment-sequence %s", err)
-	}
+	// ValueFile.Store must run before Store.NewSegmentSequence: the
+	// segment-sequence row existing is what SequenceExists treats as
+	// proof the whole StoreSequence is durable and safe to skip on
+	// retry/replay, so it must not commit until the bytes it describes
+	// are actually on disk. If ValueFile.Store fails (or the process
+	// crashes) between the two, NewSegmentSequence never runs, the
+	// segment-sequence row stays absent, and a retry correctly redoes
+	// the write (at a fresh offset) instead of silently reporting
+	// success over missing bytes.
+
+	offset := writer.ValueFile.Size()
 
 	err = writer.ValueFile.Store(segment.CollectionID, entry.SegmentID,
 		data)
 	if err != nil {
-		return fmt.Errorf("ValueFile.Store %s", err)
+		return 0, false, fmt.Errorf("ValueFile.Store %s", err)
+	}
+
+	err = writer.Store.NewSegmentSequence(segment.CollectionID, entry.SegmentID,
+		sequence, writer.ValueFile.ID(), offset)
+	if err != nil {
+		return 0, false, fmt.Errorf("NewSegmentSequence %s", err)
 	}
 
 	entry.LastActionTime = tools.Timestamp()
+	writer.mu.Lock()
 	writer.SegmentMap[key] = entry
+	writer.mu.Unlock()
+
+	return offset, false, nil
+}
+
+func (writer *nimbusioWriter) StoreSequence(lgr logger.Logger,
+	segment msg.Segment,
+	sequence msg.Sequence, data []byte) error {
+
+	lgr.Debug("StoreSequence #%d", sequence.SequenceNum)
+
+	if err := writer.logStoreSequence(segment, sequence, data); err != nil {
+		return fmt.Errorf("logStoreSequence %s", err)
+	}
+
+	offset, alreadyApplied, err := writer.applyStoreSequence(lgr, segment, sequence, data)
+	if err != nil {
+		return err
+	}
+	if alreadyApplied {
+		lgr.Info("StoreSequence #%d already applied, treating retry as a no-op",
+			sequence.SequenceNum)
+		return nil
+	}
+
+	if writer.Replicator != nil {
+		switch writer.Replicator.Policy {
+		case ReplicationQuorum:
+			failedPeers, err := writer.Replicator.ReplicateAppendSequence(segment, sequence, offset, data)
+			if err != nil {
+				// Quorum wasn't reached, but failedPeers is still the set
+				// of peers ReplicateAppendSequence knows missed the write,
+				// and recording them for handoff is the whole point of
+				// this failure path.
+				writer.recordReplicationGap(lgr, segment, sequence.SequenceNum, failedPeers)
+				return fmt.Errorf("ReplicateAppendSequence %s", err)
+			}
+			for _, peerName := range failedPeers {
+				lgr.Info("peer %s missed sequence #%d, will rely on handoff",
+					peerName, sequence.SequenceNum)
+			}
+			writer.recordReplicationGap(lgr, segment, sequence.SequenceNum, failedPeers)
+		case ReplicationAsync:
+			go func() {
+				failedPeers, err := writer.Replicator.ReplicateAppendSequence(segment, sequence, offset, data)
+				if err != nil {
+					lgr.Error("async ReplicateAppendSequence %s", err)
+					writer.recordReplicationGap(lgr, segment, sequence.SequenceNum, failedPeers)
+					return
+				}
+				writer.recordReplicationGap(lgr, segment, sequence.SequenceNum, failedPeers)
+			}()
+		}
+	}
+
+	return nil
+}
+
+// recordReplicationGap durably records, via MetadataStore, that the
+// peers in failedPeers missed sequenceNum for segment, so an
+// anti-entropy handoff process has something to consult instead of the
+// gap only ever being logged. A peer name with no entry in NodeIDMap is
+// skipped rather than failing the whole call: it means the cluster
+// membership changed after ReplicateAppendSequence started, which
+// handoff cannot act on anyway.
+func (writer *nimbusioWriter) recordReplicationGap(lgr logger.Logger,
+	segment msg.Segment, sequenceNum uint64, failedPeers []string) {
+
+	if len(failedPeers) == 0 {
+		return
+	}
+
+	peerNodeIDs := make([]uint32, 0, len(failedPeers))
+	for _, peerName := range failedPeers {
+		if nodeID, ok := writer.NodeIDMap[peerName]; ok {
+			peerNodeIDs = append(peerNodeIDs, nodeID)
+		}
+	}
+
+	if err := writer.Store.RecordReplicationGap(segment, sequenceNum, peerNodeIDs); err != nil {
+		lgr.Error("RecordReplicationGap %s", err)
+	}
+}
+
+// applyCancelSegment performs the state mutation CancelSegment needs,
+// with no WAL logging or replication of its own, so that WAL replay
+// and replicationServer.apply can drive it directly without
+// re-triggering either.
+func (writer *nimbusioWriter) applyCancelSegment(cancel msg.Cancel) error {
+	key := segmentKey{cancel.UnifiedID, cancel.ConjoinedPart,
+		cancel.SegmentNum}
+	writer.mu.Lock()
+	delete(writer.SegmentMap, key)
+	writer.mu.Unlock()
+
+	if err := writer.Store.CancelSegment(cancel); err != nil {
+		return fmt.Errorf("CancelSegment %s", err)
+	}
 
 	return nil
 }
@@ -222,281 +462,176 @@ func (writer *nimbusioWriter) StoreSequence(lgr logger.Logger,
 // CancelSegment stops storing the segment
 func (writer *nimbusioWriter) CancelSegment(lgr logger.Logger,
 	cancel msg.Cancel) error {
-	var err error
 
 	lgr.Debug("CancelSegment")
 
-	key := segmentKey{cancel.UnifiedID, cancel.ConjoinedPart,
-		cancel.SegmentNum}
-	delete(writer.SegmentMap, key)
+	if err := writer.logCancelSegment(cancel); err != nil {
+		return fmt.Errorf("logCancelSegment %s", err)
+	}
 
-	stmt := nodedb.Stmts["cancel-segment"]
-	_, err = stmt.Exec(
-		cancel.UnifiedID,
-		cancel.ConjoinedPart,
-		cancel.SegmentNum)
+	if err := writer.applyCancelSegment(cancel); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return fmt.Errorf("cancel-segment %s", err)
+	if writer.Replicator != nil {
+		for _, peerName := range writer.Replicator.ReplicateCancelSegment(cancel) {
+			lgr.Info("peer %s missed CancelSegment, will rely on handoff", peerName)
+		}
 	}
 
 	return nil
 }
 
-// FinishSegment finishes storing the segment
-func (writer *nimbusioWriter) FinishSegment(lgr logger.Logger,
-	segment msg.Segment, file msg.File) error {
-	var err error
-
-	lgr.Debug("FinishSegment")
+// applyFinishSegment performs the state mutation FinishSegment needs,
+// with no WAL logging or replication of its own, so that WAL replay
+// and replicationServer.apply can drive it directly without
+// re-triggering either.
+func (writer *nimbusioWriter) applyFinishSegment(segment msg.Segment,
+	file msg.File) error {
 
 	key := segmentKey{segment.UnifiedID, segment.ConjoinedPart,
 		segment.SegmentNum}
+	writer.mu.Lock()
 	entry, ok := writer.SegmentMap[key]
+	if ok {
+		delete(writer.SegmentMap, key)
+	}
+	writer.mu.Unlock()
 	if !ok {
 		return fmt.Errorf("FinishSegment unknown segment %s", key)
 	}
 
-	delete(writer.SegmentMap, key)
+	return writer.Store.WithTx(func(tx MetadataTx) error {
+		if err := tx.FinishSegment(entry.SegmentID, file); err != nil {
+			return fmt.Errorf("FinishSegment %s", err)
+		}
 
-	stmt := nodedb.Stmts["finish-segment"]
-	_, err = stmt.Exec(
-		file.FileSize,
-		file.Adler32,
-		file.MD5Digest,
-		entry.SegmentID)
+		for _, metaEntry := range file.MetaData {
+			if err := tx.NewMetaData(segment.CollectionID, entry.SegmentID,
+				metaEntry.Key, metaEntry.Value, segment.Timestamp); err != nil {
+				return fmt.Errorf("NewMetaData %s", err)
+			}
+		}
 
-	if err != nil {
-		return fmt.Errorf("finish-segment %s", err)
+		return nil
+	})
+}
+
+// FinishSegment finishes storing the segment
+func (writer *nimbusioWriter) FinishSegment(lgr logger.Logger,
+	segment msg.Segment, file msg.File) error {
+
+	lgr.Debug("FinishSegment")
+
+	if err := writer.logFinishSegment(segment, file); err != nil {
+		return fmt.Errorf("logFinishSegment %s", err)
 	}
 
-	for _, metaEntry := range file.MetaData {
-		stmt := nodedb.Stmts["new-meta-data"]
-		_, err = stmt.Exec(
-			segment.CollectionID,
-			entry.SegmentID,
-			metaEntry.Key,
-			metaEntry.Value,
-			segment.Timestamp)
+	if err := writer.applyFinishSegment(segment, file); err != nil {
+		return err
+	}
 
-		if err != nil {
-			return fmt.Errorf("new-meta-data %s", err)
+	if writer.Replicator != nil {
+		for _, peerName := range writer.Replicator.ReplicateCommitSegment(segment, file) {
+			lgr.Info("peer %s missed CommitSegment, will rely on handoff", peerName)
 		}
 	}
 
 	return nil
 }
 
+// applyDestroyKey performs the state mutation DestroyKey needs, with no
+// WAL logging of its own, so that WAL replay can drive it directly
+// without re-appending its own record.
+func (writer *nimbusioWriter) applyDestroyKey(segment msg.Segment,
+	unifiedIDToDestroy uint64) error {
+
+	if err := writer.Store.NewTombstone(segment, unifiedIDToDestroy); err != nil {
+		return fmt.Errorf("NewTombstone %s", err)
+	}
+
+	return nil
+}
+
 // DestroyKey makes a key inaccessible
 func (writer *nimbusioWriter) DestroyKey(lgr logger.Logger,
 	segment msg.Segment,
 	unifiedIDToDestroy uint64) error {
 
-	var err error
-
 	lgr.Debug("DestroyKey (%d)", unifiedIDToDestroy)
 
-	if unifiedIDToDestroy > 0 {
-		if segment.HandoffNodeID > 0 {
-			stmt := nodedb.Stmts["new-tombstone-for-unified-id-for-handoff"]
-			_, err = stmt.Exec(
-				segment.CollectionID,
-				segment.Key,
-				segment.UnifiedID,
-				segment.Timestamp,
-				segment.SegmentNum,
-				unifiedIDToDestroy,
-				segment.SourceNodeID,
-				segment.HandoffNodeID)
-
-			if err != nil {
-				return fmt.Errorf("new-tombstone-for-unified-id-for-handoff %d %s",
-					unifiedIDToDestroy, err)
-			}
-		} else {
-			stmt := nodedb.Stmts["new-tombstone-for-unified-id"]
-			_, err = stmt.Exec(
-				segment.CollectionID,
-				segment.Key,
-				segment.UnifiedID,
-				segment.Timestamp,
-				segment.SegmentNum,
-				unifiedIDToDestroy,
-				segment.SourceNodeID,
-				segment.HandoffNodeID)
-
-			if err != nil {
-				return fmt.Errorf("new-tombstone-for-unified-id %d %s",
-					unifiedIDToDestroy, err)
-			}
-		}
-
-		stmt := nodedb.Stmts["delete-conjoined-for-unified-id"]
-		_, err = stmt.Exec(
-			segment.Timestamp,
-			segment.CollectionID,
-			segment.Key,
-			unifiedIDToDestroy)
-
-		if err != nil {
-			return fmt.Errorf("delete-conjoined-for-unified-id %d %s",
-				unifiedIDToDestroy, err)
-		}
-	} else {
-		if segment.HandoffNodeID > 0 {
-			stmt := nodedb.Stmts["new-tombstone-for-handoff"]
-			_, err = stmt.Exec(
-				segment.CollectionID,
-				segment.Key,
-				segment.UnifiedID,
-				segment.Timestamp,
-				segment.SegmentNum,
-				segment.SourceNodeID,
-				segment.HandoffNodeID)
-
-			if err != nil {
-				return fmt.Errorf("new-tombstone-for-handoff %s", err)
-			}
-		} else {
-			stmt := nodedb.Stmts["new-tombstone"]
-			_, err = stmt.Exec(
-				segment.CollectionID,
-				segment.Key,
-				segment.UnifiedID,
-				segment.Timestamp,
-				segment.SegmentNum,
-				segment.SourceNodeID)
-
-			if err != nil {
-				return fmt.Errorf("new-tombstone %s", err)
-			}
-		}
+	if err := writer.logDestroyKey(segment, unifiedIDToDestroy); err != nil {
+		return fmt.Errorf("logDestroyKey %s", err)
+	}
 
-		stmt := nodedb.Stmts["delete-conjoined"]
-		_, err = stmt.Exec(
-			segment.Timestamp,
-			segment.CollectionID,
-			segment.Key,
-			segment.UnifiedID)
+	return writer.applyDestroyKey(segment, unifiedIDToDestroy)
+}
 
-		if err != nil {
-			return fmt.Errorf("delete-conjoined %s", err)
-		}
+// applyStartConjoined performs the state mutation StartConjoinedArchive
+// needs, with no WAL logging of its own, so that WAL replay can drive
+// it directly without re-appending its own record.
+func (writer *nimbusioWriter) applyStartConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	if err := writer.Store.StartConjoined(conjoinedEntry); err != nil {
+		return fmt.Errorf("StartConjoined %s", err)
 	}
-	// Set delete_timestamp on all conjoined rows for this key
-	// that are older than this tombstone
-
 	return nil
 }
 
 // StartConjoinedArchive begins a conjoined archive
 func (writer *nimbusioWriter) StartConjoinedArchive(lgr logger.Logger,
 	conjoinedEntry types.ConjoinedEntry) error {
-	var err error
 
 	lgr.Debug("StartConjoinedArchive %s", conjoinedEntry)
 
-	if conjoinedEntry.HandoffNodeID > 0 {
-		stmt := nodedb.Stmts["start-conjoined-for-handoff"]
-		_, err = stmt.Exec(
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID,
-			conjoinedEntry.Timestamp,
-			conjoinedEntry.HandoffNodeID)
-
-		if err != nil {
-			return fmt.Errorf("start-conjoined-for-handoff %s", err)
-		}
-	} else {
-		stmt := nodedb.Stmts["start-conjoined"]
-		_, err = stmt.Exec(
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID,
-			conjoinedEntry.Timestamp)
+	if err := writer.logConjoined(walRecordStartConjoined, conjoinedEntry); err != nil {
+		return fmt.Errorf("logConjoined %s", err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("start-conjoined %s", err)
-		}
+	return writer.applyStartConjoined(conjoinedEntry)
+}
 
+// applyAbortConjoined performs the state mutation AbortConjoinedArchive
+// needs, with no WAL logging of its own, so that WAL replay can drive
+// it directly without re-appending its own record.
+func (writer *nimbusioWriter) applyAbortConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	if err := writer.Store.AbortConjoined(conjoinedEntry); err != nil {
+		return fmt.Errorf("AbortConjoined %s", err)
 	}
-
 	return nil
 }
 
 // AbortConjoinedArchive cancels conjoined archive
 func (writer *nimbusioWriter) AbortConjoinedArchive(lgr logger.Logger,
 	conjoinedEntry types.ConjoinedEntry) error {
-	var err error
 
 	lgr.Debug("StartConjoinedArchive %s", conjoinedEntry)
 
-	if conjoinedEntry.HandoffNodeID > 0 {
-
-		stmt := nodedb.Stmts["abort-conjoined-for-handoff"]
-		_, err = stmt.Exec(
-			conjoinedEntry.Timestamp,
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID,
-			conjoinedEntry.HandoffNodeID)
-
-		if err != nil {
-			return fmt.Errorf("abort-conjoined-for-handoff %s", err)
-		}
-	} else {
-
-		stmt := nodedb.Stmts["abort-conjoined"]
-		_, err = stmt.Exec(
-			conjoinedEntry.Timestamp,
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID)
+	if err := writer.logConjoined(walRecordAbortConjoined, conjoinedEntry); err != nil {
+		return fmt.Errorf("logConjoined %s", err)
+	}
 
-		if err != nil {
-			return fmt.Errorf("abort-conjoined %s", err)
-		}
+	return writer.applyAbortConjoined(conjoinedEntry)
+}
 
+// applyFinishConjoined performs the state mutation FinishConjoinedArchive
+// needs, with no WAL logging of its own, so that WAL replay can drive
+// it directly without re-appending its own record.
+func (writer *nimbusioWriter) applyFinishConjoined(conjoinedEntry types.ConjoinedEntry) error {
+	if err := writer.Store.FinishConjoined(conjoinedEntry); err != nil {
+		return fmt.Errorf("FinishConjoined %s", err)
 	}
-
 	return nil
 }
 
 // FinishConjoinedArchive completes a conjoined archive
 func (writer *nimbusioWriter) FinishConjoinedArchive(lgr logger.Logger,
 	conjoinedEntry types.ConjoinedEntry) error {
-	var err error
 
 	lgr.Debug("FinishConjoinedArchive %s", conjoinedEntry)
 
-	if conjoinedEntry.HandoffNodeID > 0 {
-
-		stmt := nodedb.Stmts["finish-conjoined-for-handoff"]
-		_, err = stmt.Exec(
-			conjoinedEntry.Timestamp,
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID,
-			conjoinedEntry.HandoffNodeID)
-
-		if err != nil {
-			return fmt.Errorf("finish-conjoined-for-handoff %s", err)
-		}
-	} else {
-
-		stmt := nodedb.Stmts["finish-conjoined"]
-		_, err = stmt.Exec(
-			conjoinedEntry.Timestamp,
-			conjoinedEntry.CollectionID,
-			conjoinedEntry.Key,
-			conjoinedEntry.UnifiedID)
-
-		if err != nil {
-			return fmt.Errorf("finish-conjoined %s", err)
-		}
-
+	if err := writer.logConjoined(walRecordFinishConjoined, conjoinedEntry); err != nil {
+		return fmt.Errorf("logConjoined %s", err)
 	}
 
-	return nil
+	return writer.applyFinishConjoined(conjoinedEntry)
 }